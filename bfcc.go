@@ -0,0 +1,160 @@
+// run brainfuck programs from Go. a program is compiled once and can
+// then be run any number of times, even at the same time:
+//
+//	prog, err := bfcc.Compile(src, bfcc.DefaultOptions())
+//	if err != nil {
+//		return err
+//	}
+//	err = prog.Run(ctx, os.Stdin, os.Stdout)
+package bfcc
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen/interp"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+)
+
+// what ',' does when there is no input left
+type EOF = config.EOF
+
+const (
+	EOFZero      = config.EOFZero
+	EOFMinusOne  = config.EOFMinusOne
+	EOFUnchanged = config.EOFUnchanged
+	EOFError     = config.EOFError
+)
+
+// what happens when the pointer leaves the tape
+type Tape = config.Tape
+
+const (
+	TapeFixed = config.TapeFixed
+	TapeGrow  = config.TapeGrow
+	TapeWrap  = config.TapeWrap
+)
+
+// the errors a program can stop with. syntax errors come from Compile,
+// runtime errors from Run and can be inspected with errors.As
+type (
+	SyntaxError  = lexer.SyntaxError
+	RuntimeError = interp.RuntimeError
+)
+
+// what a RuntimeError is about
+type ErrorKind = interp.ErrorKind
+
+const (
+	PointerUnderflow = interp.PointerUnderflow
+	PointerOverflow  = interp.PointerOverflow
+	InputFailure     = interp.InputFailure
+	StepLimit        = interp.StepLimit
+	Canceled         = interp.Canceled
+)
+
+var (
+	// a ',' with no input left and EOFError
+	ErrEOF = config.ErrEOF
+	// the program ran more than Options.MaxSteps instructions
+	ErrStepLimit = interp.ErrStepLimit
+)
+
+type Options struct {
+	// size of a cell in bits, 8, 16, 32 or 64
+	CellBits int
+	// number of cells on the tape, where a growing tape starts from. at
+	// most config.MaxCells
+	Cells int
+	EOF   EOF
+	Tape  Tape
+	// '.' writes the cell as UTF-8 rather than a single byte
+	UTF8 bool
+	// optimization level, 0 (none) to 3 (all passes)
+	Optimize int
+	// stop after this many instructions, 0 for no limit. a deadline on
+	// the context passed to Run limits how long it can take instead
+	MaxSteps int
+}
+
+// the options bfcc itself uses, 8 bit cells on a 30,000 cell tape that
+// doesn't wrap or grow, with every optimization turned on
+func DefaultOptions() Options {
+	cfg := config.Default()
+
+	return Options{
+		CellBits: cfg.CellBits,
+		Cells:    30_000,
+		EOF:      cfg.EOF,
+		Tape:     cfg.Tape,
+		Optimize: ir.MaxLevel,
+	}
+}
+
+// a compiled brainfuck program, ready to run
+type Program struct {
+	code []*ir.Instr
+	opts Options
+}
+
+// compile src, reporting problems such as unbalanced brackets as a
+// *SyntaxError
+func Compile(src string, opts Options) (*Program, error) {
+	if opts.Cells <= 0 {
+		return nil, fmt.Errorf("the tape needs at least one cell")
+	}
+
+	if opts.Cells > config.MaxCells {
+		return nil, fmt.Errorf("a tape of %d cells is too big, the most is %d", opts.Cells, config.MaxCells)
+	}
+
+	if opts.MaxSteps < 0 {
+		return nil, fmt.Errorf("MaxSteps can't be negative")
+	}
+
+	if err := settings(opts).Validate(); err != nil {
+		return nil, err
+	}
+
+	pm, err := ir.Level(opts.Optimize)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := ir.Compile(src, pm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{code: code, opts: opts}, nil
+}
+
+func settings(opts Options) config.Config {
+	return config.Config{CellBits: opts.CellBits, EOF: opts.EOF, Tape: opts.Tape, UTF8: opts.UTF8}
+}
+
+// the options the program was compiled with
+func (p *Program) Options() Options {
+	return p.opts
+}
+
+// run the program on a fresh tape. ',' reads from stdin, which can be nil
+// for no input, and '.' writes to stdout, which can be nil to throw the
+// output away. the program stops early with a *RuntimeError when ctx is
+// done
+func (p *Program) Run(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	vm := interp.New(p.opts.Cells)
+	vm.SetConfig(settings(p.opts))
+	vm.SetMaxSteps(p.opts.MaxSteps)
+	vm.Input = stdin
+	vm.Output = stdout
+
+	return vm.RunProgram(ctx, p.code)
+}
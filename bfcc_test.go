@@ -0,0 +1,80 @@
+package bfcc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProgram(t *testing.T) {
+	// echo input back until it runs out
+	prog, err := Compile(",[.,]", DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a program can be run many times, and at the same time
+	var wg sync.WaitGroup
+	for _, in := range []string{"", "a", "hello\nworld"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var out bytes.Buffer
+			if err := prog.Run(context.Background(), strings.NewReader(in), &out); err != nil {
+				t.Errorf("%q: %s", in, err)
+			}
+
+			if out.String() != in {
+				t.Errorf("got %q, want %q", out.String(), in)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestErrors(t *testing.T) {
+	var serr *SyntaxError
+	if _, err := Compile("+[\n[]", DefaultOptions()); !errors.As(err, &serr) || serr.Pos.Line != 1 {
+		t.Errorf("got error %v, want a syntax error on line 1", err)
+	}
+
+	opts := DefaultOptions()
+	opts.CellBits = 12
+	if _, err := Compile("+", opts); err == nil {
+		t.Error("12 bit cells compiled")
+	}
+
+	opts = DefaultOptions()
+	opts.Cells = 1 << 30
+	if _, err := Compile("+", opts); err == nil {
+		t.Error("a billion cell tape compiled")
+	}
+
+	opts = DefaultOptions()
+	opts.Cells = 4
+	opts.EOF = EOFError
+
+	prog, err := Compile(">>>>", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rerr *RuntimeError
+	if err := prog.Run(context.Background(), nil, nil); err != nil {
+		t.Errorf("moving off the tape without using a cell: %s", err)
+	}
+
+	prog, _ = Compile(">>>>,", opts)
+	if err := prog.Run(context.Background(), nil, nil); !errors.As(err, &rerr) || rerr.Kind != PointerOverflow {
+		t.Errorf("got error %v, want a pointer overflow", err)
+	}
+
+	prog, _ = Compile(",", opts)
+	if err := prog.Run(context.Background(), nil, nil); !errors.Is(err, ErrEOF) {
+		t.Errorf("got error %v, want %v", err, ErrEOF)
+	}
+}
@@ -2,25 +2,51 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
-	"bfcc/pkg/gen/c"
-	"bfcc/pkg/gen/golang"
-	"bfcc/pkg/gen/interp"
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	_ "bfcc/pkg/gen/asm"
+	"bfcc/pkg/gen/bundle"
+	_ "bfcc/pkg/gen/c"
+	_ "bfcc/pkg/gen/golang"
+	_ "bfcc/pkg/gen/interp"
+	_ "bfcc/pkg/gen/jit"
+	_ "bfcc/pkg/gen/native"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
 	"bfcc/pkg/repl"
+	"bfcc/pkg/vm"
 	"github.com/jessevdk/go-flags"
 )
 
 type Options struct {
-	Output    string `short:"o" long:"output" description:"binary executable to output to"`
-	Run       bool   `short:"r" long:"run" description:"run executable after compiling"`
-	Repl      bool   `short:"R" long:"repl" description:"run the interactive brainfuck interpreter"`
-	Backend   string `short:"b" long:"backend" description:"what backend to use [C, ASM, Native, VM]"`
-	StackSize uint   `short:"s" long:"stack-size" description:"how much 'memory' to use"`
-	Input     string `short:"i" long:"input" description:"input brainfuck file"`
+	Output     string        `short:"o" long:"output" description:"binary executable to output to (default: a.out)"`
+	Run        bool          `short:"r" long:"run" description:"run executable after compiling"`
+	Repl       bool          `short:"R" long:"repl" description:"run the interactive brainfuck interpreter"`
+	Backend    string        `short:"b" long:"backend" description:"what backend to use, see --list-backends"`
+	StackSize  uint          `short:"s" long:"stack-size" description:"how much 'memory' to use"`
+	Input      string        `short:"i" long:"input" description:"input brainfuck file"`
+	Optimize   int           `short:"O" long:"optimize" description:"optimization level, 0 (none) to 3 (all passes)"`
+	CellBits   int           `long:"cell-bits" description:"size of a cell in bits, 8, 16, 32 or 64. cells are unsigned and wrap around"`
+	EOF        string        `long:"eof" description:"what ',' does at the end of input: zero, minus-one, unchanged or error"`
+	Tape       string        `long:"tape" description:"what happens at the ends of the tape: fixed (an error), grow or wrap"`
+	UTF8Output bool          `long:"utf8-output" description:"'.' writes the cell as a UTF-8 encoded code point instead of a single byte"`
+	MaxSteps   int           `long:"max-steps" description:"stop the interpreter after this many instructions, 0 for no limit"`
+	Timeout    time.Duration `long:"timeout" description:"stop the interpreter after this long, such as 5s or 1m, 0 for no limit"`
+
+	ListBackends bool   `long:"list-backends" description:"list every backend and what it can do"`
+	Emit         string `long:"emit" description:"write the program as c, go, asm, bytecode, ir or tokens to --output or stdout instead of compiling it"`
+	KeepSource   bool   `long:"keep-source" description:"keep the generated source next to the executable"`
+	CC           string `long:"cc" description:"C compiler for the c backend (default: $CC, or gcc, cc or clang)"`
+	CFlags       string `long:"cflags" description:"flags for the C compiler (default: $CFLAGS, or -O3 -s)"`
 }
 
 var opts Options
@@ -28,31 +54,75 @@ var opts Options
 func init() {
 	opts.StackSize = 30_000
 	opts.Backend = "c"
-	opts.Output = "a.out"
+	opts.Optimize = ir.MaxLevel
+	opts.CellBits = config.Default().CellBits
+	opts.EOF = config.Default().EOF.String()
+	opts.Tape = config.Default().Tape.String()
 }
 
-func Interp(input string) error {
-	vm := interp.New(int(opts.StackSize))
-	vm.Input = os.Stdin
-	vm.Output = os.Stdout
-
-	return vm.Generate(input, opts.Output)
+// the runtime behaviour picked on the command line, checked by Run
+// before any backend sees it
+func settings() config.Config {
+	cfg := config.Default()
+	cfg.CellBits = opts.CellBits
+	cfg.EOF, _ = config.ParseEOF(opts.EOF)
+	cfg.Tape, _ = config.ParseTape(opts.Tape)
+	cfg.UTF8 = opts.UTF8Output
+	return cfg
 }
 
-func RunGo(input, output string) error {
-	gogen := golang.New(opts.StackSize)
-	err := gogen.Generate(input, output)
-	if err != nil {
-		return err
+// print every backend, what it is called and what it can do
+func ListBackends() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tALIASES\tCAPABILITIES\tDESCRIPTION")
+	for _, b := range gen.Backends() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.Name, strings.Join(b.Aliases, ","), b.Caps, b.Description)
 	}
+	w.Flush()
+}
+
+// write the program as source code, bytecode, the ir or the tokens it is
+// made of to --output, or stdout without one
+func Emit(input string, pm *ir.PassManager) error {
+	var out []byte
+
+	switch opts.Emit {
+	case "tokens":
+		tokens, err := lexer.New(input).Parse()
+		if err != nil {
+			return err
+		}
+		out = []byte(lexer.Dump(tokens))
+
+	case "ir":
+		prog, err := ir.Compile(input, pm)
+		if err != nil {
+			return err
+		}
+		out = []byte(ir.Dump(prog))
 
-	if opts.Run {
-		if err := Execute(opts.Output); err != nil {
+	default:
+		backend, err := gen.Lookup(opts.Emit)
+		if err != nil {
+			return err
+		}
+
+		if !backend.Has(gen.Source) {
+			return fmt.Errorf("the %s backend has no source to emit, try c, go, asm, bytecode, ir or tokens", backend.Name)
+		}
+
+		g := backend.New(gen.Options{Cells: opts.StackSize, Passes: pm, Config: settings()})
+		if out, err = g.(gen.Emitter).Source(input); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	if opts.Output == "" {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+
+	return os.WriteFile(opts.Output, out, 0o644)
 }
 
 func Run(args []string) error {
@@ -71,30 +141,123 @@ func Run(args []string) error {
 		return err
 	}
 
-	// run interpreter
-	if opts.Backend[0] == 'i' || opts.Backend == "vm" {
-		return Interp(string(b))
+	// bytecode is mostly not brainfuck, so it would run as nonsense
+	if vm.IsFile(b) {
+		return fmt.Errorf("%s is compiled bytecode, run it with 'bfcc run %s'", input, input)
 	}
 
-	if opts.Backend[0] == 'g' || opts.Backend == "go" {
-		return RunGo(string(b), opts.Output)
+	// report unbalanced brackets against the file before any backend runs
+	if _, err := lexer.New(string(b)).Parse(); err != nil {
+		return fmt.Errorf("%s:%w", input, err)
 	}
 
-	cgen := cgen.New(opts.StackSize)
-	err = cgen.Generate(string(b), opts.Output)
+	pm, err := ir.Level(opts.Optimize)
 	if err != nil {
 		return err
 	}
 
-	if opts.Run {
-		if err := Execute(opts.Output); err != nil {
-			return err
-		}
+	if err := checkSettings(); err != nil {
+		return err
+	}
+
+	if opts.MaxSteps < 0 || opts.Timeout < 0 {
+		return fmt.Errorf("--max-steps and --timeout can't be negative")
+	}
+
+	if opts.Emit != "" {
+		return Emit(string(b), pm)
+	}
+
+	if opts.Output == "" {
+		opts.Output = "a.out"
+	}
+
+	backend, err := gen.Lookup(opts.Backend)
+	if err != nil {
+		return err
+	}
+
+	// only some backends can stop a program part way through
+	if (opts.MaxSteps != 0 || opts.Timeout != 0) && !backend.Has(gen.Limits) {
+		return fmt.Errorf("--max-steps and --timeout don't work with the %s backend", backend.Name)
+	}
+
+	g := backend.New(gen.Options{
+		Cells:      opts.StackSize,
+		Passes:     pm,
+		Config:     settings(),
+		Input:      os.Stdin,
+		Output:     os.Stdout,
+		MaxSteps:   opts.MaxSteps,
+		Timeout:    opts.Timeout,
+		KeepSource: opts.KeepSource,
+		CC:         opts.CC,
+		CFlags:     strings.Fields(opts.CFlags),
+	})
+
+	if err := g.Generate(string(b), opts.Output); err != nil {
+		return err
+	}
+
+	if opts.Run && backend.Has(gen.Executable) {
+		return Execute(opts.Output)
 	}
 
 	return nil
 }
 
+// whether 'bfcc run path' means running bytecode. anything else is left
+// alone, so a brainfuck file that happens to be called run still compiles
+func IsBytecode(path string) bool {
+	if strings.HasSuffix(path, ".bfc") {
+		return true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+
+	return vm.IsFile(head)
+}
+
+// run a bytecode file written by --emit=bytecode, with the settings it was
+// compiled with
+func RunFile(path string) error {
+	// the vm has no way of stopping a program part way through
+	if opts.MaxSteps != 0 || opts.Timeout != 0 {
+		return fmt.Errorf("--max-steps and --timeout don't work with bytecode, run the source with --backend=interp instead")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f vm.File
+	if err := f.UnmarshalBinary(b); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return RunBytecode(&f)
+}
+
+// run a compiled program on stdin and stdout
+func RunBytecode(f *vm.File) error {
+	v := vm.New(f.Cells)
+	v.SetConfig(f.Config)
+	v.Input = os.Stdin
+	v.Output = os.Stdout
+
+	return v.Run(f.Program)
+}
+
 func Execute(path string) error {
 	cmdname, err := filepath.Abs(path)
 	if err != nil {
@@ -114,12 +277,50 @@ func Execute(path string) error {
 	return nil
 }
 
+// the tape size and runtime behaviour must make sense before anything
+// runs with them
+func checkSettings() error {
+	if opts.StackSize == 0 {
+		return fmt.Errorf("the tape needs at least one cell")
+	}
+
+	if opts.StackSize > config.MaxCells {
+		return fmt.Errorf("a tape of %d cells is too big, the most is %d", opts.StackSize, config.MaxCells)
+	}
+
+	if _, err := config.ParseEOF(opts.EOF); err != nil {
+		return err
+	}
+
+	if _, err := config.ParseTape(opts.Tape); err != nil {
+		return err
+	}
+
+	return settings().Validate()
+}
+
 func RunRepl() error {
-	// return repl.Start()
-	return repl.Readline()
+	if err := checkSettings(); err != nil {
+		return err
+	}
+
+	// return repl.Start(int(opts.StackSize), settings())
+	return repl.Readline(int(opts.StackSize), settings())
 }
 
 func main() {
+	// executables made by the bundle backend are bfcc with a program on
+	// the end, which runs instead of bfcc itself
+	if f, err := bundle.Embedded(); err != nil {
+		log.Fatal(err)
+	} else if f != nil {
+		if err := RunBytecode(f); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
 	args, err := flags.Parse(&opts)
 	if err != nil {
 		if flags.WroteHelp(err) {
@@ -129,6 +330,11 @@ func main() {
 		}
 	}
 
+	if opts.ListBackends {
+		ListBackends()
+		os.Exit(0)
+	}
+
 	if opts.Repl {
 		if err := RunRepl(); err != nil {
 			log.Fatal(err)
@@ -137,6 +343,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(args) == 2 && args[0] == "run" && IsBytecode(args[1]) {
+		if err := RunFile(args[1]); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+
 	if err := Run(args); err != nil {
 		log.Fatal(err)
 	}
@@ -7,13 +7,25 @@ import (
 	"strings"
 	"time"
 
+	"bfcc/pkg/config"
 	debug "bfcc/pkg/dbg"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/jessevdk/go-flags"
 )
 
+// the same runtime settings bfcc takes, so a program behaves the same
+// when it is stepped through
+type Options struct {
+	StackSize  uint   `short:"s" long:"stack-size" description:"how much 'memory' to use"`
+	CellBits   int    `long:"cell-bits" description:"size of a cell in bits, 8, 16, 32 or 64. cells are unsigned and wrap around"`
+	EOF        string `long:"eof" description:"what ',' does at the end of input: zero, minus-one, unchanged or error"`
+	Tape       string `long:"tape" description:"what happens at the ends of the tape: fixed (an error), grow or wrap"`
+	UTF8Output bool   `long:"utf8-output" description:"'.' writes the cell as a UTF-8 encoded code point instead of a single byte"`
+}
+
 type Styles struct {
 	BorderColor lipgloss.Color
 	BorderBlur  lipgloss.Color
@@ -65,7 +77,7 @@ type model struct {
 	stdoutHeight int
 }
 
-func initialModel() model {
+func initialModel(cells int, cfg config.Config) model {
 	styles := DefaultStyles()
 
 	input := textinput.New()
@@ -94,7 +106,8 @@ func initialModel() model {
 		return nil
 	}
 
-	vm := debug.New(1200, true)
+	vm := debug.New(cells, true)
+	vm.SetConfig(cfg)
 
 	// emulate stdout
 	// var outbuf *bytes.Buffer
@@ -341,6 +354,7 @@ func (m model) RenderStatus() string {
 		s += "paused"
 	}
 
+	s += fmt.Sprintf(" %s |", m.vm.Position())
 	s += " ctrl+j speed++ | ctrl+k speed-- | reset | ctrl+a format | open <file>"
 
 	return m.styles.TextHelp.Render(s)
@@ -395,8 +409,52 @@ func (m model) View() string {
 	)
 }
 
+// the settings given on the command line, checked before the debugger
+// starts
+func settings(opts Options) (config.Config, error) {
+	if opts.StackSize == 0 {
+		return config.Config{}, fmt.Errorf("the tape needs at least one cell")
+	}
+
+	if opts.StackSize > config.MaxCells {
+		return config.Config{}, fmt.Errorf("a tape of %d cells is too big, the most is %d", opts.StackSize, config.MaxCells)
+	}
+
+	var err error
+	cfg := config.Default()
+	cfg.CellBits = opts.CellBits
+	cfg.UTF8 = opts.UTF8Output
+	if cfg.EOF, err = config.ParseEOF(opts.EOF); err != nil {
+		return config.Config{}, err
+	}
+	if cfg.Tape, err = config.ParseTape(opts.Tape); err != nil {
+		return config.Config{}, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
 func main() {
-	p := tea.NewProgram(initialModel(), tea.WithAltScreen())
+	opts := Options{
+		StackSize: 1200,
+		CellBits:  config.Default().CellBits,
+		EOF:       config.Default().EOF.String(),
+		Tape:      config.Default().Tape.String(),
+	}
+
+	if _, err := flags.Parse(&opts); err != nil {
+		if flags.WroteHelp(err) {
+			os.Exit(0)
+		}
+		log.Fatal(err)
+	}
+
+	cfg, err := settings(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := tea.NewProgram(initialModel(int(opts.StackSize), cfg), tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,229 @@
+// settings that change what a brainfuck program does when it runs. every
+// backend honors them, so a program behaves the same however it is run
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// what ',' does when there is no input left
+type EOF int
+
+const (
+	// store 0 in the cell
+	EOFZero EOF = iota
+	// store -1 in the cell, which is every bit set
+	EOFMinusOne
+	// leave the cell as it was
+	EOFUnchanged
+	// stop the program with ErrEOF
+	EOFError
+)
+
+var eofNames = [...]string{
+	EOFZero:      "zero",
+	EOFMinusOne:  "minus-one",
+	EOFUnchanged: "unchanged",
+	EOFError:     "error",
+}
+
+func (e EOF) String() string {
+	if e < 0 || int(e) >= len(eofNames) {
+		return fmt.Sprintf("eof(%d)", int(e))
+	}
+	return eofNames[e]
+}
+
+// parse one of zero, minus-one, unchanged or error
+func ParseEOF(s string) (EOF, error) {
+	for e, name := range eofNames {
+		if s == name {
+			return EOF(e), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown eof behaviour %q, expected %s", s, strings.Join(eofNames[:], ", "))
+}
+
+// returned when a program reads past the end of its input with EOFError
+var ErrEOF = errors.New("unexpected end of input")
+
+// what happens when the pointer leaves the tape
+type Tape int
+
+const (
+	// the tape has a fixed number of cells, using a cell outside of it
+	// stops the program with an error
+	TapeFixed Tape = iota
+	// the tape grows on demand in both directions, so cells left of the
+	// starting cell can be used too
+	TapeGrow
+	// the tape is circular, moving off one end comes back on the other
+	TapeWrap
+)
+
+var tapeNames = [...]string{
+	TapeFixed: "fixed",
+	TapeGrow:  "grow",
+	TapeWrap:  "wrap",
+}
+
+func (t Tape) String() string {
+	if t < 0 || int(t) >= len(tapeNames) {
+		return fmt.Sprintf("tape(%d)", int(t))
+	}
+	return tapeNames[t]
+}
+
+// parse one of fixed, grow or wrap
+func ParseTape(s string) (Tape, error) {
+	for t, name := range tapeNames {
+		if s == name {
+			return Tape(t), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown tape mode %q, expected %s", s, strings.Join(tapeNames[:], ", "))
+}
+
+// the most cells a tape can start with. interpreted tapes take 8 bytes a
+// cell, so this is 128 MiB, and bytecode files asking for more are refused
+// rather than trusted to allocate it
+const MaxCells = 1 << 24
+
+// how far a growing tape can grow on either side of cell 0, cells from
+// -MaxGrow up to MaxGrow-1 can be used. at 8 bytes a cell each side is
+// 2 GiB, going past it is reported the same way as leaving a fixed tape
+const MaxGrow = 1 << 28
+
+// the message every backend reports a cell outside of a fixed tape with
+const OutOfRange = "pointer out of range"
+
+type Config struct {
+	// width of a cell in bits, one of 8, 16, 32 or 64. cells are unsigned
+	// and wrap around when they overflow
+	CellBits int
+	// what reading past the end of input does
+	EOF EOF
+	// what happens at the ends of the tape
+	Tape Tape
+	// '.' writes the cell as a UTF-8 encoded code point rather than as
+	// the single byte in its low 8 bits
+	UTF8 bool
+}
+
+// 8 bit wrapping cells that read 0 at the end of input on a fixed size
+// tape, what most brainfuck programs expect
+func Default() Config {
+	return Config{
+		CellBits: 8,
+		EOF:      EOFZero,
+		Tape:     TapeFixed,
+	}
+}
+
+func (c Config) Validate() error {
+	switch c.CellBits {
+	case 8, 16, 32, 64:
+	default:
+		return fmt.Errorf("unsupported cell size %d, expected 8, 16, 32 or 64", c.CellBits)
+	}
+
+	if c.EOF < 0 || int(c.EOF) >= len(eofNames) {
+		return fmt.Errorf("unknown eof behaviour %s", c.EOF)
+	}
+
+	if c.Tape < 0 || int(c.Tape) >= len(tapeNames) {
+		return fmt.Errorf("unknown tape mode %s", c.Tape)
+	}
+
+	return nil
+}
+
+// the bits of a cell that are kept after arithmetic
+func (c Config) Mask() uint64 {
+	if c.CellBits >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<c.CellBits - 1
+}
+
+// size of a cell in bytes
+func (c Config) CellSize() int {
+	return c.CellBits / 8
+}
+
+// wrap a value into the range of a cell
+func (c Config) Wrap(n int) uint64 {
+	return uint64(n) & c.Mask()
+}
+
+// read a byte of input into a cell holding old, returning what it holds
+// afterwards. at the end of input, or with no input at all, the cell is
+// set following the eof behaviour
+func (c Config) ReadCell(r io.Reader, old uint64) (uint64, error) {
+	buf := make([]byte, 1)
+
+	var err error
+	if r == nil {
+		err = io.EOF
+	} else {
+		_, err = io.ReadFull(r, buf)
+	}
+
+	switch {
+	case err == nil:
+		return uint64(buf[0]), nil
+	case err != io.EOF:
+		return old, err
+	case c.EOF == EOFMinusOne:
+		return c.Mask(), nil
+	case c.EOF == EOFUnchanged:
+		return old, nil
+	case c.EOF == EOFError:
+		return old, ErrEOF
+	}
+
+	return 0, nil
+}
+
+// make room for cell i on a growing tape, where cell 0 is tape[origin].
+// the tape at least doubles so growing it one cell at a time doesn't copy
+// it every time, but never past MaxGrow. returns the new tape and where
+// cell 0 is on it, ok is false if i is too far out to fit
+func Grow(tape []uint64, origin, i int) (t []uint64, o int, ok bool) {
+	if i < -MaxGrow || i >= MaxGrow {
+		return tape, origin, false
+	}
+
+	n := max(len(tape), 1)
+	lo, hi := -origin, len(tape)-origin
+
+	for i < lo || i >= hi {
+		if i < lo {
+			lo = max(lo-n, -MaxGrow)
+		} else {
+			hi = min(hi+n, MaxGrow)
+		}
+		n = hi - lo
+	}
+
+	t = make([]uint64, hi-lo)
+	copy(t[-origin-lo:], tape)
+	return t, -lo, true
+}
+
+// the code point a cell is written as with UTF8. cells that aren't a
+// valid code point, like surrogates or anything past U+10FFFF, are
+// written as U+FFFD
+func Rune(cell uint64) rune {
+	if cell > unicode.MaxRune || !utf8.ValidRune(rune(cell)) {
+		return utf8.RuneError
+	}
+	return rune(cell)
+}
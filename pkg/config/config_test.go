@@ -0,0 +1,51 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadCell(t *testing.T) {
+	failing := errors.New("broken")
+
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		r    io.Reader
+		want uint64
+		err  error
+	}{
+		{name: "byte", cfg: Config{CellBits: 16}, r: strings.NewReader("A"), want: 'A'},
+		{name: "zero", cfg: Config{CellBits: 8, EOF: EOFZero}, r: strings.NewReader(""), want: 0},
+		{name: "minus one", cfg: Config{CellBits: 16, EOF: EOFMinusOne}, r: strings.NewReader(""), want: 0xffff},
+		{name: "unchanged", cfg: Config{CellBits: 8, EOF: EOFUnchanged}, r: strings.NewReader(""), want: 7},
+		{name: "error", cfg: Config{CellBits: 8, EOF: EOFError}, r: strings.NewReader(""), want: 7, err: ErrEOF},
+		// no reader at all is the end of input
+		{name: "no input", cfg: Config{CellBits: 8, EOF: EOFMinusOne}, want: 0xff},
+		// anything else is passed on, leaving the cell alone
+		{name: "failing", cfg: Default(), r: iotest.ErrReader(failing), want: 7, err: failing},
+	} {
+		got, err := tc.cfg.ReadCell(tc.r, 7)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %d, %v, want %d, %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestGrow(t *testing.T) {
+	// growing left keeps every cell where it was relative to cell 0
+	tape, origin, ok := Grow([]uint64{1, 2}, 0, -3)
+	if !ok || origin < 3 || len(tape) < origin+2 || tape[origin] != 1 || tape[origin+1] != 2 {
+		t.Fatalf("grow left: got %v with cell 0 at %d", tape, origin)
+	}
+
+	// and nothing past MaxGrow on either side fits
+	for _, i := range []int{MaxGrow, -MaxGrow - 1} {
+		if _, _, ok := Grow(tape, origin, i); ok {
+			t.Errorf("grew to cell %d", i)
+		}
+	}
+}
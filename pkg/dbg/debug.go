@@ -1,7 +1,9 @@
 // a special brainfuck stack that is concurrency safe
 // and that allows you to step through instructions at any speed
 // using a generated function. This is intended to operate like
-// GDB or Blinkenlights but for brainfuck
+// GDB or Blinkenlights but for brainfuck. unlike the backends it runs the
+// lexer's tokens rather than the optimized ir, so every step is exactly
+// one character of the source
 package debug
 
 import (
@@ -10,6 +12,7 @@ import (
 	"strings"
 	"sync"
 
+	"bfcc/pkg/config"
 	"bfcc/pkg/lexer"
 
 	"github.com/muesli/reflow/wordwrap"
@@ -18,8 +21,10 @@ import (
 type Debug struct {
 	// the programs tokens
 	Tokens []*lexer.Token
+	// index of the matching bracket for each bracket token
+	jumps []int
 	// out programs memory / tape
-	Memory []int
+	Memory []uint64
 	// usually stdin, for ',' read instruction
 	Input io.Reader
 	// usually stdout, for writing to
@@ -41,6 +46,12 @@ type Debug struct {
 	c Color
 	// testing a token window for printing instructions
 	tokenWindow int
+	// cells are kept to these bits after every change
+	mask uint64
+	// how cells, input and the tape behave
+	cfg config.Config
+	// index into Memory of cell 0, growing tapes can have cells left of it
+	origin int
 }
 
 type StepFn func() error
@@ -50,11 +61,12 @@ func New(stacksize int, hascolor bool) *Debug {
 	l := lexer.Repl()
 
 	vm := &Debug{
-		Memory: make([]int, stacksize),
+		Memory: make([]uint64, stacksize),
 		ptr:    0,
 		repl:   l,
 		step:   func() error { return nil },
 	}
+	vm.SetConfig(config.Default())
 
 	if hascolor {
 		vm.c.Compute()
@@ -68,11 +80,25 @@ func (v *Debug) SetStep(fn StepFn) {
 	v.step = fn
 }
 
+// choose how cells behave
+func (v *Debug) SetConfig(cfg config.Config) {
+	v.cfg = cfg
+	v.mask = cfg.Mask()
+}
+
 // return the current pointer value
 func (v *Debug) Ptr() int {
 	return v.ptr
 }
 
+// where in the source the current instruction came from
+func (v *Debug) Position() lexer.Position {
+	if v.offset >= len(v.Tokens) {
+		return lexer.Position{}
+	}
+	return v.Tokens[v.offset].Pos
+}
+
 // print the current instruction set as a string
 // looks rad af
 func (v *Debug) PrintState(width int) string {
@@ -156,7 +182,7 @@ func (v *Debug) DumpMemory(format string, wrap int) string {
 		str := fmt.Sprintf(format, n)
 		str2 := fmt.Sprintf("|%s%s%s", string(clr), str, string(nocolor))
 
-		if v.ptr == i {
+		if v.ptr+v.origin == i {
 			str2 = fmt.Sprintf("\x1b[34m%s\x1b[0m", str2)
 		}
 
@@ -178,10 +204,19 @@ func (v *Debug) Eval(instruction string) error {
 		return fmt.Errorf("repl has not been initialized")
 	}
 
-	tokens := v.repl.Read(instruction)
+	tokens, err := v.repl.Read(instruction)
+	if err != nil {
+		return err
+	}
+
+	jumps, err := lexer.Jumps(tokens)
+	if err != nil {
+		return err
+	}
+
 	v.Tokens = tokens
+	v.jumps = jumps
 	v.offset = 0
-	v.repl.Zero()
 
 	for v.offset < len(v.Tokens) {
 		// allow us to slow execution
@@ -201,9 +236,51 @@ func (v *Debug) Eval(instruction string) error {
 	return nil
 }
 
+// read a byte of input into cell c, following the configured eof
+// behaviour when there is none left
+func (v *Debug) read(c int) error {
+	var err error
+	v.Memory[c], err = v.cfg.ReadCell(v.Input, v.Memory[c])
+	return err
+}
+
+// the index into Memory of the current cell. growing tapes are extended
+// to fit it and wrapping tapes bring it back around, ok is false if a
+// fixed tape doesn't have the cell or a growing one can't grow to it
+func (v *Debug) cell() (c int, ok bool) {
+	switch v.cfg.Tape {
+	case config.TapeWrap:
+		c = v.ptr % len(v.Memory)
+		if c < 0 {
+			c += len(v.Memory)
+		}
+		return c, true
+
+	case config.TapeGrow:
+		if v.ptr+v.origin < 0 || v.ptr+v.origin >= len(v.Memory) {
+			if v.Memory, v.origin, ok = config.Grow(v.Memory, v.origin, v.ptr); !ok {
+				return 0, false
+			}
+		}
+		return v.ptr + v.origin, true
+	}
+
+	return v.ptr, v.ptr >= 0 && v.ptr < len(v.Memory)
+}
+
 // evaluate the current instruction
 func (v *Debug) evaluate() error {
 	tok := v.Tokens[v.offset]
+
+	// every token but a move works on the current cell
+	var c int
+	if tok.Type != lexer.INC_PTR && tok.Type != lexer.DEC_PTR {
+		var ok bool
+		if c, ok = v.cell(); !ok {
+			return fmt.Errorf("%s: %s", tok.Pos, config.OutOfRange)
+		}
+	}
+
 	switch tok.Type {
 
 	case lexer.INC_PTR:
@@ -213,72 +290,34 @@ func (v *Debug) evaluate() error {
 		v.ptr -= tok.Repeat
 
 	case lexer.INC_CELL:
-		v.Memory[v.ptr] += tok.Repeat
+		v.Memory[c] = (v.Memory[c] + uint64(tok.Repeat)) & v.mask
 
 	case lexer.DEC_CELL:
-		v.Memory[v.ptr] -= tok.Repeat
+		v.Memory[c] = (v.Memory[c] - uint64(tok.Repeat)) & v.mask
 
 	case lexer.OUTPUT:
-		// fmt.Fprintf(v.Output, "%c", rune(v.Memory[v.ptr]))
-		v.SB.WriteString(fmt.Sprintf("%c", rune(v.Memory[v.ptr])))
+		if v.cfg.UTF8 {
+			v.SB.WriteRune(config.Rune(v.Memory[c]))
+		} else {
+			v.SB.WriteByte(byte(v.Memory[c]))
+		}
 
 	case lexer.INPUT:
-		buf := make([]byte, 1)
-		b, err := v.Input.Read(buf)
-		if err != nil {
+		if err := v.read(c); err != nil {
 			return err
 		}
 
-		if b != 1 {
-			return fmt.Errorf("read %d bytes of input, not 1", b)
-		}
-
-		v.Memory[v.ptr] = int(buf[0])
-
 	case lexer.LOOP_OPEN:
-		// advance if our loop counter is not 0 (which is when we stop looping)
-		if v.Memory[v.ptr] != 0 {
-			v.offset++
-			return nil
+		// skip past the loop if our loop counter is 0
+		if v.Memory[c] == 0 {
+			v.offset = v.jumps[v.offset]
 		}
 
-		// counting the depth of our loops (they are often deeply nested)
-		depth := 1
-		for depth != 0 {
-			v.offset++
-			switch v.Tokens[v.offset].Type {
-			case lexer.LOOP_OPEN:
-				depth++
-			case lexer.LOOP_CLOSE:
-				depth--
-			}
-			v.step()
-		}
-
-		return nil
-
 	case lexer.LOOP_CLOSE:
-		// if our loop is over, move on
-		if v.Memory[v.ptr] == 0 {
-			v.offset++
-			return nil
+		// go back to the start of the loop unless it is over
+		if v.Memory[c] != 0 {
+			v.offset = v.jumps[v.offset]
 		}
-
-		// counting the depth of our loops (they are often deeply nested)
-		// same as LOOP_OPEN but in reverse
-		depth := 1
-		for depth != 0 {
-			v.offset--
-			switch v.Tokens[v.offset].Type {
-			case lexer.LOOP_OPEN:
-				depth--
-			case lexer.LOOP_CLOSE:
-				depth++
-			}
-			v.step()
-		}
-
-		return nil
 	}
 
 	// next instruction
@@ -0,0 +1,551 @@
+// this package handles turning a brainfuck program into x86-64 linux
+// assembly (GNU as syntax) that is assembled and linked without libc
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+	"bfcc/pkg/x86"
+)
+
+type GenAsm struct {
+	input   string
+	output  string
+	memsize uint
+	passes  *ir.PassManager
+	cfg     config.Config
+	// leave the assembly source behind after compiling it
+	keep bool
+	// every loop gets a unique label number
+	label int
+	// out of line code reporting a cell off the tape, one per position
+	faults map[lexer.Position]int
+	order  []lexer.Position
+	// and reporting the end of input with --eof=error
+	eofs     map[lexer.Position]int
+	eofOrder []lexer.Position
+}
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "asm",
+		Aliases:     []string{"assembly"},
+		Description: "x86-64 linux assembly, assembled and linked with as and ld",
+		Caps:        gen.Executable | gen.Toolchain | gen.Source,
+		New: func(o gen.Options) gen.Generator {
+			g := New(o.Cells)
+			g.SetPasses(o.Passes)
+			g.SetConfig(o.Config)
+			g.SetKeepSource(o.KeepSource)
+			return g
+		},
+	})
+}
+
+func New(memsize uint) *GenAsm {
+	return &GenAsm{
+		memsize: memsize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before generating code
+func (a *GenAsm) SetPasses(pm *ir.PassManager) {
+	a.passes = pm
+}
+
+// choose how cells behave
+func (a *GenAsm) SetConfig(cfg config.Config) {
+	a.cfg = cfg
+}
+
+// keep the generated assembly file next to the executable, it is removed
+// once compiled otherwise
+func (a *GenAsm) SetKeepSource(keep bool) {
+	a.keep = keep
+}
+
+// operand size keyword and the matching part of rax for each cell size
+var widths = map[int]struct{ ptr, rax string }{
+	8:  {"byte", "al"},
+	16: {"word", "ax"},
+	32: {"dword", "eax"},
+	64: {"qword", "rax"},
+}
+
+// the address of the cell at offset from the pointer. fixed and growing
+// tapes check it is between r12 and r13 first, wrapping tapes work it out
+// in scratch
+func (a *GenAsm) at(buf *bytes.Buffer, offset int, scratch string, pos lexer.Position) string {
+	disp := int64(offset) * int64(a.cfg.CellSize())
+
+	if a.cfg.Tape == config.TapeWrap {
+		// rbx is always on the tape, so the cell is at most one span
+		// past the end of it
+		d := a.wrap(disp)
+		if d == 0 {
+			return "rbx"
+		}
+
+		a.label++
+		buf.WriteString(fmt.Sprintf("        lea %s, [rbx + %d]\n", scratch, d))
+		buf.WriteString(fmt.Sprintf("        cmp %s, r13\n", scratch))
+		buf.WriteString(fmt.Sprintf("        jb .Lon%d\n", a.label))
+		buf.WriteString(fmt.Sprintf("        sub %s, %d\n", scratch, a.span()))
+		buf.WriteString(fmt.Sprintf(".Lon%d:\n", a.label))
+		return scratch
+	}
+
+	addr, check := "rbx", "rbx"
+	if disp != 0 {
+		addr = fmt.Sprintf("rbx + %d", disp)
+		buf.WriteString(fmt.Sprintf("        lea %s, [%s]\n", scratch, addr))
+		check = scratch
+	}
+
+	fault := a.fault(pos)
+	buf.WriteString(fmt.Sprintf("        cmp %s, r12\n", check))
+	buf.WriteString(fmt.Sprintf("        jb %s\n", fault))
+	buf.WriteString(fmt.Sprintf("        cmp %s, r13\n", check))
+	buf.WriteString(fmt.Sprintf("        jae %s\n", fault))
+
+	return addr
+}
+
+// the memory operand for a cell at addr
+func (a *GenAsm) cell(addr string) string {
+	return fmt.Sprintf("%s ptr [%s]", widths[a.cfg.CellBits].ptr, addr)
+}
+
+// the label reporting that the instruction at pos left the tape
+func (a *GenAsm) fault(pos lexer.Position) string {
+	if _, ok := a.faults[pos]; !ok {
+		a.faults[pos] = len(a.order)
+		a.order = append(a.order, pos)
+	}
+	return fmt.Sprintf(".Lfault%d", a.faults[pos])
+}
+
+// the label reporting that the ',' at pos ran out of input
+func (a *GenAsm) eof(pos lexer.Position) string {
+	if _, ok := a.eofs[pos]; !ok {
+		a.eofs[pos] = len(a.eofOrder)
+		a.eofOrder = append(a.eofOrder, pos)
+	}
+	return fmt.Sprintf(".Leof%d", a.eofs[pos])
+}
+
+// size of a wrapping tape in bytes
+func (a *GenAsm) span() int64 {
+	return int64(a.memsize) * int64(a.cfg.CellSize())
+}
+
+// n bytes brought into [0, span)
+func (a *GenAsm) wrap(n int64) int64 {
+	n %= a.span()
+	if n < 0 {
+		n += a.span()
+	}
+	return n
+}
+
+// move the pointer by n cells
+func (a *GenAsm) move(buf *bytes.Buffer, n int) {
+	if a.cfg.Tape != config.TapeWrap {
+		buf.WriteString(fmt.Sprintf("        add rbx, %d\n", n*a.cfg.CellSize()))
+		return
+	}
+
+	d := a.wrap(int64(n) * int64(a.cfg.CellSize()))
+	if d == 0 {
+		return
+	}
+
+	a.label++
+	buf.WriteString(fmt.Sprintf("        add rbx, %d\n", d))
+	buf.WriteString("        cmp rbx, r13\n")
+	buf.WriteString(fmt.Sprintf("        jb .Lon%d\n", a.label))
+	buf.WriteString(fmt.Sprintf("        sub rbx, %d\n", a.span()))
+	buf.WriteString(fmt.Sprintf(".Lon%d:\n", a.label))
+}
+
+// instructions can only hold 32 bit immediates, so for 64 bit cells
+// bigger constants have to go through a register
+func (a *GenAsm) fits(n int) bool {
+	return a.cfg.CellBits < 64 || int(int32(n)) == n
+}
+
+// the immediate for adding or storing n into a cell
+func (a *GenAsm) imm(n int) string {
+	if a.cfg.CellBits < 64 {
+		return fmt.Sprint(a.cfg.Wrap(n))
+	}
+	return fmt.Sprint(n)
+}
+
+func (a *GenAsm) writeBlock(buf *bytes.Buffer, block []*ir.Instr) error {
+	w := widths[a.cfg.CellBits]
+
+	for _, in := range block {
+		switch in.Op {
+		case ir.Move:
+			a.move(buf, in.Arg)
+		case ir.Add:
+			c := a.cell(a.at(buf, in.Offset, "rsi", in.Pos))
+			if a.fits(in.Arg) {
+				buf.WriteString(fmt.Sprintf("        add %s, %s\n", c, a.imm(in.Arg)))
+			} else {
+				buf.WriteString(fmt.Sprintf("        movabs rax, %d\n", in.Arg))
+				buf.WriteString(fmt.Sprintf("        add %s, rax\n", c))
+			}
+		case ir.Set:
+			c := a.cell(a.at(buf, in.Offset, "rsi", in.Pos))
+			if a.fits(in.Arg) {
+				buf.WriteString(fmt.Sprintf("        mov %s, %s\n", c, a.imm(in.Arg)))
+			} else {
+				buf.WriteString(fmt.Sprintf("        movabs rax, %d\n", in.Arg))
+				buf.WriteString(fmt.Sprintf("        mov %s, rax\n", c))
+			}
+		case ir.MulAdd:
+			src := a.cell(a.at(buf, in.Src, "rsi", in.Pos))
+			dst := a.cell(a.at(buf, in.Offset, "rdx", in.Pos))
+			switch a.cfg.CellBits {
+			case 8, 16:
+				buf.WriteString(fmt.Sprintf("        movzx eax, %s\n", src))
+			default:
+				buf.WriteString(fmt.Sprintf("        mov %s, %s\n", w.rax, src))
+			}
+
+			switch {
+			case a.cfg.CellBits < 64:
+				buf.WriteString(fmt.Sprintf("        imul eax, eax, %d\n", int32(in.Arg)))
+			case a.fits(in.Arg):
+				buf.WriteString(fmt.Sprintf("        imul rax, rax, %d\n", in.Arg))
+			default:
+				buf.WriteString(fmt.Sprintf("        movabs rcx, %d\n", in.Arg))
+				buf.WriteString("        imul rax, rcx\n")
+			}
+			buf.WriteString(fmt.Sprintf("        add %s, %s\n", dst, w.rax))
+		case ir.Output:
+			addr := a.at(buf, in.Offset, "rsi", in.Pos)
+			if a.cfg.UTF8 {
+				switch a.cfg.CellBits {
+				case 8, 16:
+					buf.WriteString(fmt.Sprintf("        movzx eax, %s\n", a.cell(addr)))
+				default:
+					buf.WriteString(fmt.Sprintf("        mov %s, %s\n", widths[a.cfg.CellBits].rax, a.cell(addr)))
+				}
+				buf.WriteString("        call utf8_out\n")
+				break
+			}
+
+			// write(1, cell, 1), the low byte of the cell comes first
+			buf.WriteString(fmt.Sprintf("        lea rsi, [%s]\n", addr))
+			buf.WriteString("        mov eax, 1\n")
+			buf.WriteString("        mov edi, 1\n")
+			buf.WriteString("        mov edx, 1\n")
+			buf.WriteString("        syscall\n")
+		case ir.Input:
+			// read(0, rsp - 8, 1) into the red zone, then widen the byte
+			// into the cell. anything but a byte arriving is the end of
+			// input. the cell's address is kept in r15, which syscalls
+			// leave alone
+			addr := a.at(buf, in.Offset, "rsi", in.Pos)
+			a.label++
+			n := a.label
+			buf.WriteString(fmt.Sprintf("        lea r15, [%s]\n", addr))
+			buf.WriteString("        xor eax, eax\n")
+			buf.WriteString("        xor edi, edi\n")
+			buf.WriteString("        lea rsi, [rsp - 8]\n")
+			buf.WriteString("        mov edx, 1\n")
+			buf.WriteString("        syscall\n")
+			buf.WriteString("        cmp rax, 1\n")
+			buf.WriteString(fmt.Sprintf("        je .Linput%d\n", n))
+			switch a.cfg.EOF {
+			case config.EOFZero:
+				buf.WriteString(fmt.Sprintf("        mov %s, 0\n", a.cell("r15")))
+			case config.EOFMinusOne:
+				buf.WriteString(fmt.Sprintf("        mov %s, -1\n", a.cell("r15")))
+			case config.EOFError:
+				buf.WriteString(fmt.Sprintf("        jmp %s\n", a.eof(in.Pos)))
+			}
+			buf.WriteString(fmt.Sprintf("        jmp .Linputdone%d\n", n))
+			buf.WriteString(fmt.Sprintf(".Linput%d:\n", n))
+			buf.WriteString("        movzx eax, byte ptr [rsp - 8]\n")
+			buf.WriteString(fmt.Sprintf("        mov %s, %s\n", a.cell("r15"), w.rax))
+			buf.WriteString(fmt.Sprintf(".Linputdone%d:\n", n))
+		case ir.Scan:
+			a.label++
+			n := a.label
+			buf.WriteString(fmt.Sprintf(".Lscan%d:\n", n))
+			buf.WriteString(fmt.Sprintf("        cmp %s, 0\n", a.cell(a.at(buf, 0, "rsi", in.Pos))))
+			buf.WriteString(fmt.Sprintf("        je .Lscanned%d\n", n))
+			a.move(buf, in.Arg)
+			buf.WriteString(fmt.Sprintf("        jmp .Lscan%d\n", n))
+			buf.WriteString(fmt.Sprintf(".Lscanned%d:\n", n))
+		case ir.Loop:
+			a.label++
+			n := a.label
+			buf.WriteString(fmt.Sprintf("        # loop at %s\n", in.Pos))
+			buf.WriteString(fmt.Sprintf("        cmp %s, 0\n", a.cell(a.at(buf, 0, "rsi", in.Pos))))
+			buf.WriteString(fmt.Sprintf("        je .Lend%d\n", n))
+			buf.WriteString(fmt.Sprintf(".Lstart%d:\n", n))
+			if err := a.writeBlock(buf, in.Body); err != nil {
+				return err
+			}
+			buf.WriteString(fmt.Sprintf("        cmp %s, 0\n", a.cell(a.at(buf, 0, "rsi", in.Pos))))
+			buf.WriteString(fmt.Sprintf("        jne .Lstart%d\n", n))
+			buf.WriteString(fmt.Sprintf(".Lend%d:\n", n))
+		default:
+			// instruction not handled, decide what to do here
+			return fmt.Errorf("unhandled instruction: %s", in)
+		}
+	}
+
+	return nil
+}
+
+// fixed and wrapping tapes are the .bss tape
+const bssTape = `
+        lea rbx, [rip + tape]
+        mov r12, rbx
+        lea r13, [rip + tape + %[1]d]
+`
+
+// set up rbx, r12 and r13 for each kind of tape
+var tapes = map[config.Tape]string{
+	config.TapeFixed: bssTape,
+	config.TapeWrap:  bssTape,
+	// mmap(0, reserve, PROT_READ|PROT_WRITE, MAP_PRIVATE|MAP_ANONYMOUS|
+	// MAP_NORESERVE, -1, 0) lots of address space and start in the middle,
+	// the kernel only hands out pages once they are touched
+	config.TapeGrow: `
+        mov eax, 9
+        xor edi, edi
+        movabs rsi, %[2]d
+        mov edx, 3
+        mov r10d, 0x4022
+        mov r8, -1
+        xor r9d, r9d
+        syscall
+        test rax, rax
+        js no_tape
+        mov r12, rax
+        lea r13, [rax + rsi]
+        shr rsi, 1
+        lea rbx, [rax + rsi]
+`,
+}
+
+// write(1, ...) the code point in rax as UTF-8, encoded below the stack
+// pointer. anything that isn't a code point is written as U+FFFD
+const utf8Out = `
+utf8_out:
+        cmp rax, 0x80
+        jb .Lutf8_1
+        cmp rax, 0x800
+        jb .Lutf8_2
+        mov rcx, rax
+        sub rcx, 0xd800
+        cmp rcx, 0x800
+        jb .Lutf8_bad
+        cmp rax, 0x10000
+        jb .Lutf8_3
+        cmp rax, 0x110000
+        jb .Lutf8_4
+.Lutf8_bad:
+        mov eax, 0xfffd
+        jmp .Lutf8_3
+`
+
+// the n byte UTF-8 encoding of rax, for utf8_out
+func utf8Bytes(buf *bytes.Buffer, n int) {
+	lead := []int{0, 0x00, 0xc0, 0xe0, 0xf0}[n]
+
+	buf.WriteString(fmt.Sprintf(".Lutf8_%d:\n", n))
+	for i := 0; i < n; i++ {
+		shift := 6 * (n - 1 - i)
+		buf.WriteString("        mov rcx, rax\n")
+		if shift > 0 {
+			buf.WriteString(fmt.Sprintf("        shr rcx, %d\n", shift))
+		}
+		switch {
+		case i > 0:
+			buf.WriteString("        and rcx, 0x3f\n")
+			buf.WriteString("        or rcx, 0x80\n")
+		case n > 1:
+			buf.WriteString(fmt.Sprintf("        or rcx, 0x%x\n", lead))
+		}
+		buf.WriteString(fmt.Sprintf("        mov byte ptr [rsp - %d], cl\n", 8-i))
+	}
+	buf.WriteString(fmt.Sprintf("        mov edx, %d\n", n))
+	buf.WriteString("        jmp .Lutf8_write\n")
+}
+
+// print a message to stderr and exit(1)
+func (a *GenAsm) fail(buf *bytes.Buffer, label, msg string) {
+	a.label++
+	buf.WriteString(fmt.Sprintf("%s:\n", label))
+	buf.WriteString(fmt.Sprintf("        lea rsi, [rip + .Lmsg%d]\n", a.label))
+	buf.WriteString(fmt.Sprintf("        mov edx, %d\n", len(msg)+1))
+	buf.WriteString("        jmp die\n")
+	buf.WriteString("        .section .rodata\n")
+	buf.WriteString(fmt.Sprintf(".Lmsg%d:\n        .ascii %q\n", a.label, msg+"\n"))
+	buf.WriteString("        .text\n")
+}
+
+func (a *GenAsm) generateSrc() ([]byte, error) {
+	var buf bytes.Buffer
+	var start = `
+/*
+* This program is auto-generated by bfcc
+* sweetbbak
+*
+* rbx holds the address of the current cell, r12 and r13 the ends of
+* the tape
+*/
+        .intel_syntax noprefix
+
+        .bss
+        .lcomm tape, %d
+
+        .text
+        .globl _start
+_start:`
+
+	// add memory size to header
+	start = fmt.Sprintf(start, a.span())
+	buf.WriteString(start)
+	buf.WriteString(fmt.Sprintf(tapes[a.cfg.Tape], a.span(), x86.GrowReserve(x86.Width(a.cfg.CellSize()))))
+
+	// build and optimize the program
+	program, err := ir.Compile(a.input, a.passes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.writeBlock(&buf, program); err != nil {
+		return nil, err
+	}
+
+	// exit(0)
+	buf.WriteString("        mov eax, 60\n")
+	buf.WriteString("        xor edi, edi\n")
+	buf.WriteString("        syscall\n")
+
+	// write(2, rsi, rdx), exit(1)
+	buf.WriteString("die:\n")
+	buf.WriteString("        mov eax, 1\n")
+	buf.WriteString("        mov edi, 2\n")
+	buf.WriteString("        syscall\n")
+	buf.WriteString("        mov eax, 60\n")
+	buf.WriteString("        mov edi, 1\n")
+	buf.WriteString("        syscall\n")
+
+	if a.cfg.UTF8 {
+		buf.WriteString(utf8Out)
+		for n := 1; n <= 4; n++ {
+			utf8Bytes(&buf, n)
+		}
+		buf.WriteString(".Lutf8_write:\n")
+		buf.WriteString("        lea rsi, [rsp - 8]\n")
+		buf.WriteString("        mov eax, 1\n")
+		buf.WriteString("        mov edi, 1\n")
+		buf.WriteString("        syscall\n")
+		buf.WriteString("        ret\n")
+	}
+
+	if a.cfg.Tape == config.TapeGrow {
+		a.fail(&buf, "no_tape", "could not map the tape")
+	}
+
+	for i, pos := range a.order {
+		a.fail(&buf, fmt.Sprintf(".Lfault%d", i), fmt.Sprintf("%s: %s", pos, config.OutOfRange))
+	}
+
+	for i, pos := range a.eofOrder {
+		a.fail(&buf, fmt.Sprintf(".Leof%d", i), fmt.Sprintf("%s: %s", pos, config.ErrEOF))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (a *GenAsm) compileSrc(spath string) error {
+	obj := a.output + ".o"
+
+	as := exec.Command(
+		"as",
+		"--64",
+		"-o", obj,
+		spath,
+	)
+
+	as.Stdout = os.Stdout
+	as.Stderr = os.Stderr
+
+	if err := as.Run(); err != nil {
+		return err
+	}
+
+	ld := exec.Command(
+		"ld",
+		"-static",
+		"-s",
+		"-o", a.output,
+		obj,
+	)
+
+	ld.Stdout = os.Stdout
+	ld.Stderr = os.Stderr
+
+	if err := ld.Run(); err != nil {
+		return err
+	}
+
+	return os.Remove(obj)
+}
+
+// the assembly for a brainfuck program, without assembling it
+func (a *GenAsm) Source(input string) ([]byte, error) {
+	a.input = input
+	a.label = 0
+	a.faults = map[lexer.Position]int{}
+	a.order = nil
+	a.eofs = map[lexer.Position]int{}
+	a.eofOrder = nil
+	return a.generateSrc()
+}
+
+func (a *GenAsm) Generate(input string, output string) error {
+	a.output = output
+	tmp := a.output + ".s"
+
+	b, err := a.Source(input)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if !a.keep {
+		defer os.Remove(tmp)
+	}
+
+	err = a.compileSrc(tmp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package asm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"bfcc/pkg/config"
+)
+
+func TestAssemble(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("needs linux/amd64")
+	}
+
+	for _, tool := range []string{"as", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hello")
+
+	// echo a line back in upper case, on a tape of 16 bit cells
+	g := New(8)
+	g.SetConfig(config.Config{CellBits: 16, EOF: config.EOFMinusOne})
+	if err := g.Generate(",+[-"+strings.Repeat("-", 32)+".,+]", out); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(out)
+	cmd.Stdin = strings.NewReader("hello")
+	got, err := cmd.Output()
+	if err != nil || string(got) != "HELLO" {
+		t.Errorf("got %q, %v want %q", got, err, "HELLO")
+	}
+
+	// only the executable is left behind
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+
+	if !slices.Equal(names, []string{"hello"}) {
+		t.Errorf("got %q in the output directory", names)
+	}
+
+	// unless the source is wanted
+	g.SetKeepSource(true)
+	if err := g.Generate("+", out); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(out + ".s"); err != nil {
+		t.Errorf("source wasn't kept: %s", err)
+	}
+}
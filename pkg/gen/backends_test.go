@@ -0,0 +1,265 @@
+package gen_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	_ "bfcc/pkg/gen/asm"
+	_ "bfcc/pkg/gen/bundle"
+	_ "bfcc/pkg/gen/c"
+	_ "bfcc/pkg/gen/golang"
+	_ "bfcc/pkg/gen/interp"
+	_ "bfcc/pkg/gen/jit"
+	_ "bfcc/pkg/gen/native"
+	"bfcc/pkg/ir"
+	_ "bfcc/pkg/vm"
+)
+
+// example programs that finish on their own, with the input they need.
+// slow ones take far too long to interpret, so only backends that compile
+// to machine code run them
+var examples = []struct {
+	name  string
+	input string
+	slow  bool
+}{
+	{"helloworld.bf", "", false},
+	{"hello-world.bf", "", false},
+	{"fibonacci.bf", "", false},
+	{"quine.bf", "", false},
+	{"bizzfuzz.bf", "", false},
+	{"factor.bf", "4098\n", false},
+	{"mandelbrot.bf", "", true},
+}
+
+// backends that interpret the program rather than compile it
+var interpreted = map[string]bool{"interp": true, "vm": true}
+
+// what a backend needs installed to build programs
+var tools = map[string][]string{
+	"asm": {"as", "ld"},
+	"c":   {"gcc"},
+	"go":  {"go"},
+}
+
+// skip the test when the backend can't run here
+func available(t *testing.T, b gen.Backend) {
+	t.Helper()
+
+	switch b.Name {
+	case "bundle":
+		// its executables are a copy of the running program, which is
+		// the test binary rather than bfcc
+		t.Skip("bundled executables only run as bfcc")
+	case "asm", "jit", "native":
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			t.Skipf("%s needs linux/amd64", b.Name)
+		}
+	}
+
+	for _, tool := range tools[b.Name] {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+}
+
+// run src with a backend, returning what it wrote and the error it stopped
+// with. executables report errors on stderr and exit with 1, the message
+// comes back as the error
+func run(t *testing.T, b gen.Backend, src, input string, o gen.Options) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	if o.Cells == 0 {
+		o.Cells = 30_000
+	}
+	if o.Passes == nil {
+		o.Passes = ir.Default()
+	}
+	if o.Config.CellBits == 0 {
+		o.Config.CellBits = 8
+	}
+	o.Input = strings.NewReader(input)
+	o.Output = &out
+
+	if !b.Has(gen.Executable) {
+		err := b.New(o).Generate(src, "")
+		return out.String(), err
+	}
+
+	exe := filepath.Join(t.TempDir(), "a.out")
+	if err := b.New(o).Generate(src, exe); err != nil {
+		t.Fatalf("%s: %s", b.Name, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(exe)
+	cmd.Stdin = o.Input
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	var exit *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exit) {
+		return out.String(), errors.New(strings.TrimSuffix(stderr.String(), "\n"))
+	} else if err != nil {
+		t.Fatalf("%s: %s", b.Name, err)
+	}
+
+	return out.String(), nil
+}
+
+// what the examples print, worked out once with the vm
+var want = map[string]string{}
+
+func expected(t *testing.T, name, src, input string) string {
+	t.Helper()
+
+	if out, ok := want[name]; ok {
+		return out
+	}
+
+	vm, err := gen.Lookup("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run(t, vm, src, input, gen.Options{})
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+
+	want[name] = out
+	return out
+}
+
+func TestExamples(t *testing.T) {
+	for _, b := range gen.Backends() {
+		t.Run(b.Name, func(t *testing.T) {
+			available(t, b)
+
+			// toolchains are slow to start, so they only build the
+			// unoptimized and fully optimized programs, and none at all
+			// with -short
+			if testing.Short() && b.Has(gen.Toolchain) {
+				t.Skip("toolchains are skipped with -short")
+			}
+
+			levels := []int{0, 1, 2, 3}
+			if b.Has(gen.Toolchain) {
+				levels = []int{0, ir.MaxLevel}
+			}
+
+			for _, ex := range examples {
+				if ex.slow && (testing.Short() || interpreted[b.Name]) {
+					continue
+				}
+
+				src, err := os.ReadFile(filepath.Join("..", "..", "examples", ex.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, level := range levels {
+					if ex.slow && level != ir.MaxLevel {
+						continue
+					}
+
+					pm, _ := ir.Level(level)
+					got, err := run(t, b, string(src), ex.input, gen.Options{Passes: pm})
+					if err != nil {
+						t.Errorf("%s -O%d: %s", ex.name, level, err)
+						continue
+					}
+
+					if want := expected(t, ex.name, string(src), ex.input); got != want {
+						t.Errorf("%s -O%d: got\n%q\nwant\n%q", ex.name, level, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// how programs behave with every cell size, eof and tape setting, which
+// has to be the same whichever backend runs them
+var behaviour = []struct {
+	name  string
+	src   string
+	input string
+	cells uint
+	cfg   config.Config
+	out   string
+	err   string
+}{
+	{name: "echo", src: ",[.,]", input: "hello\n", out: "hello\n"},
+
+	// 256 wraps to zero in a byte, so 'A' is only printed by wider cells
+	{name: "8 bit cells", src: wide, cfg: config.Config{CellBits: 8}, out: ""},
+	{name: "16 bit cells", src: wide, cfg: config.Config{CellBits: 16}, out: "A"},
+	{name: "32 bit cells", src: wide, cfg: config.Config{CellBits: 32}, out: "A"},
+	{name: "64 bit cells", src: wide, cfg: config.Config{CellBits: 64}, out: "A"},
+
+	{name: "eof zero", src: "+++++++.,.", cfg: config.Config{EOF: config.EOFZero}, out: "\x07\x00"},
+	{name: "eof minus one", src: "+++++++.,.", cfg: config.Config{EOF: config.EOFMinusOne}, out: "\x07\xff"},
+	{name: "eof unchanged", src: "+++++++.,.", cfg: config.Config{EOF: config.EOFUnchanged}, out: "\x07\x07"},
+	{name: "eof error", src: "+++++++.,.", cfg: config.Config{EOF: config.EOFError}, out: "\x07", err: "1:9: " + config.ErrEOF.Error()},
+	// -1 fills the whole cell, so adding one wraps it to zero
+	{name: "eof minus one 16 bit", src: ",+.", cfg: config.Config{CellBits: 16, EOF: config.EOFMinusOne}, out: "\x00"},
+	// a byte of input replaces the whole cell, not just its low byte
+	{name: "input 16 bit", src: "-,.", input: "A", cfg: config.Config{CellBits: 16, UTF8: true}, out: "A"},
+
+	// fixed tapes stop at the first cell off the tape
+	{name: "fixed underflow", src: "+>+\n<<+", cells: 4, err: "2:3: " + config.OutOfRange},
+	{name: "fixed overflow", src: "+.>>>>+", cells: 4, out: "\x01", err: "1:7: " + config.OutOfRange},
+	// wrapping tapes come back around on the other side
+	{name: "wrap", src: "+<++<<<<+++>.>.>.>.", cells: 4, cfg: config.Config{Tape: config.TapeWrap}, out: "\x01\x00\x00\x05"},
+	// growing tapes make room on either side, keeping cell 0 in place
+	{name: "grow", src: "+<++>>>>>+++<<<<<[.>]>>>.", cells: 2, cfg: config.Config{Tape: config.TapeGrow}, out: "\x02\x01\x03"},
+	// a multiplication loop whose target is off the tape grows it
+	{name: "grow far", src: strings.Repeat("<", 100_000) + "+." + strings.Repeat(">", 200_000) + "++.", cells: 1, cfg: config.Config{Tape: config.TapeGrow}, out: "\x01\x02"},
+	{name: "grow multiply", src: "+++[->>>>++<<<<]>>>>.", cells: 2, cfg: config.Config{Tape: config.TapeGrow}, out: "\x06"},
+
+	// '.' writes bytes above 127 as they are, or code points with utf8,
+	// replacing anything that isn't one
+	{name: "raw bytes", src: "-.+++.", out: "\xff\x02"},
+	{name: "utf8", src: "-.+.>++++++++[<++++++++>-]<+.", cfg: config.Config{CellBits: 32, UTF8: true}, out: "\ufffd\x00A"},
+}
+
+// sets a cell to 256 and prints 'A' if it isn't zero
+const wide = "++++++++++++++++[>++++++++++++++++<-]>[<++++++++[>>++++++++<<-]>>+.<[-]]"
+
+func TestBehaviour(t *testing.T) {
+	for _, b := range gen.Backends() {
+		t.Run(b.Name, func(t *testing.T) {
+			available(t, b)
+
+			for _, tc := range behaviour {
+				got, err := run(t, b, tc.src, tc.input, gen.Options{Cells: tc.cells, Config: tc.cfg})
+				if message(err) != tc.err {
+					t.Errorf("%s: got error %q, want %q", tc.name, message(err), tc.err)
+				}
+
+				if got != tc.out {
+					t.Errorf("%s: got %q, want %q", tc.name, got, tc.out)
+				}
+			}
+		})
+	}
+}
+
+// the text of an error, empty for none
+func message(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
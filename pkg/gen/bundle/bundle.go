@@ -0,0 +1,189 @@
+// this package makes an executable out of a copy of bfcc itself, with the
+// program's bytecode appended to the end. bfcc checks its own file for a
+// program when it starts and runs it instead of reading the command line,
+// so nothing but bfcc is needed to build one
+package bundle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/vm"
+)
+
+// the end of a bundled executable is the bytecode file, its length as a
+// little endian uint64, then this
+const trailer = "bfcbundl"
+
+const trailerSize = 8 + len(trailer)
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "bundle",
+		Description: "a copy of bfcc with the program's bytecode appended, runs anywhere bfcc does without a toolchain",
+		Caps:        gen.Executable,
+		New: func(o gen.Options) gen.Generator {
+			g := New(o.Cells)
+			g.SetPasses(o.Passes)
+			g.SetConfig(o.Config)
+			return g
+		},
+	})
+}
+
+type GenBundle struct {
+	memsize uint
+	passes  *ir.PassManager
+	cfg     config.Config
+}
+
+func New(memsize uint) *GenBundle {
+	return &GenBundle{
+		memsize: memsize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before compiling
+func (g *GenBundle) SetPasses(pm *ir.PassManager) {
+	g.passes = pm
+}
+
+// choose how cells behave
+func (g *GenBundle) SetConfig(cfg config.Config) {
+	g.cfg = cfg
+}
+
+func (g *GenBundle) Generate(input string, outpath string) error {
+	v := vm.New(int(g.memsize))
+	v.SetPasses(g.passes)
+	v.SetConfig(g.cfg)
+
+	code, err := v.Source(input)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can't find the bfcc executable to copy: %w", err)
+	}
+
+	return write(exe, outpath, code)
+}
+
+// copy the executable at exe to outpath, with code appended
+func write(exe, outpath string, code []byte) error {
+	if same(exe, outpath) {
+		return fmt.Errorf("%s is bfcc itself, pick another output", outpath)
+	}
+
+	src, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(outpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	tail := binary.LittleEndian.AppendUint64(code, uint64(len(code)))
+	tail = append(tail, trailer...)
+
+	if _, err := dst.Write(tail); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// whether two paths are the same file, writing over the running bfcc
+// would leave nothing to copy from
+func same(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(ai, bi)
+}
+
+// the program appended to the running executable, or nil when it is plain
+// bfcc. a program that is there but can't be read is an error
+func Embedded() (*vm.File, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil
+	}
+
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return nil, nil
+	}
+
+	return read(exe)
+}
+
+func read(path string) (*vm.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if size < int64(trailerSize) {
+		return nil, nil
+	}
+
+	tail := make([]byte, trailerSize)
+	if _, err := f.ReadAt(tail, size-int64(trailerSize)); err != nil {
+		return nil, err
+	}
+
+	if string(tail[8:]) != trailer {
+		return nil, nil
+	}
+
+	n := binary.LittleEndian.Uint64(tail)
+	if n > uint64(size-int64(trailerSize)) {
+		return nil, fmt.Errorf("%s: %w", path, vm.ErrBadFile)
+	}
+
+	code := make([]byte, n)
+	if _, err := f.ReadAt(code, size-int64(trailerSize)-int64(n)); err != nil {
+		return nil, err
+	}
+
+	var prog vm.File
+	if err := prog.UnmarshalBinary(code); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &prog, nil
+}
@@ -0,0 +1,69 @@
+package bundle
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bfcc/pkg/vm"
+)
+
+func TestBundle(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "bfcc")
+	out := filepath.Join(dir, "hello")
+
+	// anything stands in for bfcc, it is only copied
+	if err := os.WriteFile(exe, []byte("\x7fELF and the rest of bfcc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// plain bfcc has nothing on the end
+	if f, err := read(exe); f != nil || err != nil {
+		t.Fatalf("got %v, %v for plain bfcc", f, err)
+	}
+
+	code, err := vm.New(8).Source("+[>+<-].")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(exe, out, code); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(exe, exe, code); err == nil {
+		t.Error("wrote over bfcc itself")
+	}
+
+	f, err := read(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want vm.File
+	if err := want.UnmarshalBinary(code); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f, &want) {
+		t.Errorf("got %+v, want %+v", f, &want)
+	}
+
+	// a length running off the front of the file is damage, not a bundle
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[len(b)-trailerSize+7] = 0xff
+	if err := os.WriteFile(out, b, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := read(out); !errors.Is(err, vm.ErrBadFile) {
+		t.Errorf("got error %v for a damaged bundle", err)
+	}
+}
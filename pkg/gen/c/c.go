@@ -7,24 +7,295 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
 
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
 	"bfcc/pkg/lexer"
 )
 
-type Generator interface {
-	// takes program input, and creates outfile
-	Generate(input string, outpath string) error
-}
-
 type GenC struct {
 	input   string
 	output  string
 	memsize uint
+	passes  *ir.PassManager
+	cfg     config.Config
+	// leave the C source behind after compiling it
+	keep bool
+	// the compiler and its flags, empty to pick them from the environment
+	cc     string
+	cflags []string
+}
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "c",
+		Description: "C compiled with gcc, clang or another C compiler, the fastest programs",
+		Caps:        gen.Executable | gen.Toolchain | gen.Source,
+		New: func(o gen.Options) gen.Generator {
+			g := New(o.Cells)
+			g.SetPasses(o.Passes)
+			g.SetConfig(o.Config)
+			g.SetKeepSource(o.KeepSource)
+			g.SetCompiler(o.CC, o.CFlags)
+			return g
+		},
+	})
 }
 
 func New(memsize uint) *GenC {
 	return &GenC{
 		memsize: memsize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before generating code
+func (c *GenC) SetPasses(pm *ir.PassManager) {
+	c.passes = pm
+}
+
+// choose how cells behave
+func (c *GenC) SetConfig(cfg config.Config) {
+	c.cfg = cfg
+}
+
+// keep the generated C file next to the executable, it is removed
+// once compiled otherwise
+func (c *GenC) SetKeepSource(keep bool) {
+	c.keep = keep
+}
+
+// choose the C compiler and the flags it is given. an empty cc uses $CC,
+// or the first of gcc, cc and clang that is installed. no flags uses
+// $CFLAGS, or -O3 -s
+func (c *GenC) SetCompiler(cc string, flags []string) {
+	c.cc = cc
+	c.cflags = flags
+}
+
+// compilers tried in order when none was picked
+var compilers = []string{"gcc", "cc", "clang"}
+
+// the compiler to run, see SetCompiler. like make, cc can hold arguments
+// too, as in CC="ccache gcc"
+func (c *GenC) compiler() ([]string, error) {
+	if cc := strings.Fields(c.cc); len(cc) > 0 {
+		return cc, nil
+	}
+
+	if cc := strings.Fields(os.Getenv("CC")); len(cc) > 0 {
+		return cc, nil
+	}
+
+	for _, cc := range compilers {
+		if _, err := exec.LookPath(cc); err == nil {
+			return []string{cc}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no C compiler found, tried %s. pick one with --cc or $CC", strings.Join(compilers, ", "))
+}
+
+// the flags to compile with, see SetCompiler
+func (c *GenC) flags() []string {
+	if len(c.cflags) > 0 {
+		return c.cflags
+	}
+
+	if flags := strings.Fields(os.Getenv("CFLAGS")); len(flags) > 0 {
+		return flags
+	}
+
+	return []string{"-O3", "-s"}
+}
+
+// the C expression for the cell at offset from the pointer, pos is
+// reported if the cell isn't on the tape
+func cell(offset int, pos lexer.Position) string {
+	switch {
+	case offset > 0:
+		return fmt.Sprintf("*at(idx+%d, \"%s\")", offset, pos)
+	case offset < 0:
+		return fmt.Sprintf("*at(idx-%d, \"%s\")", -offset, pos)
+	default:
+		return fmt.Sprintf("*at(idx, \"%s\")", pos)
+	}
+}
+
+// how each kind of tape is declared and how at() finds a cell on it
+var tapes = map[config.Tape]string{
+	config.TapeFixed: `
+cell array[CELLS];
+
+static void fault(const char *pos) {
+        fprintf(stderr, "%s: ` + config.OutOfRange + `\n", pos);
+        exit(1);
+}
+
+static inline cell *at(long i, const char *pos) {
+        if (i < 0 || i >= CELLS)
+                fault(pos);
+        return &array[i];
+}
+`,
+	config.TapeWrap: `
+cell array[CELLS];
+
+static inline cell *at(long i, const char *pos) {
+        (void)pos;
+        i %= CELLS;
+        if (i < 0)
+                i += CELLS;
+        return &array[i];
+}
+`,
+	config.TapeGrow: `
+/* tape holds the cells from lo up to hi, it grows whenever a cell
+ * outside of that is used, but no further than MAXGROW either way */
+#define MAXGROW ` + strconv.Itoa(config.MaxGrow) + `L
+cell *tape;
+long lo, hi;
+
+static cell *grow(long i, const char *pos) {
+        if (i < -MAXGROW || i >= MAXGROW) {
+                fprintf(stderr, "%s: ` + config.OutOfRange + `\n", pos);
+                exit(1);
+        }
+
+        long nlo = lo, nhi = hi;
+        if (nlo == nhi)
+                nhi = nlo + CELLS;
+        while (i < nlo || i >= nhi) {
+                long n = nhi - nlo;
+                if (i < nlo)
+                        nlo = nlo - n < -MAXGROW ? -MAXGROW : nlo - n;
+                else
+                        nhi = nhi + n > MAXGROW ? MAXGROW : nhi + n;
+        }
+
+        cell *t = calloc(nhi - nlo, sizeof(cell));
+        if (!t) {
+                fprintf(stderr, "%s: out of memory\n", pos);
+                exit(1);
+        }
+
+        if (tape)
+                memcpy(t + (lo - nlo), tape, (hi - lo) * sizeof(cell));
+        free(tape);
+        tape = t;
+        lo = nlo;
+        hi = nhi;
+        return &tape[i - lo];
+}
+
+static inline cell *at(long i, const char *pos) {
+        if (i < lo || i >= hi)
+                return grow(i, pos);
+        return &tape[i - lo];
+}
+`,
+}
+
+func (c *GenC) writeBlock(buf *bytes.Buffer, block []*ir.Instr) error {
+	for _, in := range block {
+		switch in.Op {
+		case ir.Move:
+			if in.Arg < 0 {
+				buf.WriteString(fmt.Sprintf("  idx -= %d;\n", -in.Arg))
+			} else {
+				buf.WriteString(fmt.Sprintf("  idx += %d;\n", in.Arg))
+			}
+		case ir.Add:
+			if in.Arg < 0 {
+				buf.WriteString(fmt.Sprintf("  %s -= %d;\n", cell(in.Offset, in.Pos), -in.Arg))
+			} else {
+				buf.WriteString(fmt.Sprintf("  %s += %d;\n", cell(in.Offset, in.Pos), in.Arg))
+			}
+		case ir.Set:
+			buf.WriteString(fmt.Sprintf("  %s = %d;\n", cell(in.Offset, in.Pos), in.Arg))
+		case ir.MulAdd:
+			// the source is read first, finding the destination can grow
+			// the tape and move the cells around
+			buf.WriteString(fmt.Sprintf("  { cell s = %s; %s += s * %d; }\n", cell(in.Src, in.Pos), cell(in.Offset, in.Pos), in.Arg))
+		case ir.Output:
+			if c.cfg.UTF8 {
+				buf.WriteString(fmt.Sprintf("   output(%s);\n", cell(in.Offset, in.Pos)))
+			} else {
+				buf.WriteString(fmt.Sprintf("   putchar((unsigned char)%s);\n", cell(in.Offset, in.Pos)))
+			}
+		case ir.Input:
+			buf.WriteString(fmt.Sprintf("   input(&%s, \"%s\");\n", cell(in.Offset, in.Pos), in.Pos))
+		case ir.Scan:
+			// libc's memchr and memrchr are much faster than looking
+			// at a cell at a time, but only work on byte sized cells
+			// that don't wrap or grow. not finding a zero means the
+			// scan would have run off the tape
+			fast := c.cfg.CellBits == 8 && c.cfg.Tape == config.TapeFixed
+			switch {
+			case in.Arg == 1 && fast:
+				buf.WriteString(fmt.Sprintf("   { cell *p = memchr(at(idx, \"%[1]s\"), 0, CELLS - idx); if (!p) fault(\"%[1]s\"); idx = p - array; }\n", in.Pos))
+			case in.Arg == -1 && fast:
+				buf.WriteString(fmt.Sprintf("   { cell *p = memrchr(array, 0, at(idx, \"%[1]s\") - array + 1); if (!p) fault(\"%[1]s\"); idx = p - array; }\n", in.Pos))
+			default:
+				buf.WriteString(fmt.Sprintf("   while ( %s ) idx += %d;\n", cell(0, in.Pos), in.Arg))
+			}
+		case ir.Loop:
+			buf.WriteString(fmt.Sprintf("   while ( %s ) {\n", cell(0, in.Pos)))
+			if err := c.writeBlock(buf, in.Body); err != nil {
+				return err
+			}
+			buf.WriteString("}\n")
+		default:
+			// instruction not handled, decide what to do here
+			return fmt.Errorf("unhandled instruction: %s", in)
+		}
+	}
+
+	return nil
+}
+
+// writes a cell as UTF-8 for --utf8-output, anything that isn't a code
+// point is written as U+FFFD
+const utf8Output = `
+static void output(uint64_t c) {
+        if (c > 0x10ffff || (c >= 0xd800 && c < 0xe000))
+                c = 0xfffd;
+
+        if (c < 0x80) {
+                putchar(c);
+        } else if (c < 0x800) {
+                putchar(0xc0 | c >> 6);
+                putchar(0x80 | (c & 0x3f));
+        } else if (c < 0x10000) {
+                putchar(0xe0 | c >> 12);
+                putchar(0x80 | (c >> 6 & 0x3f));
+                putchar(0x80 | (c & 0x3f));
+        } else {
+                putchar(0xf0 | c >> 18);
+                putchar(0x80 | (c >> 12 & 0x3f));
+                putchar(0x80 | (c >> 6 & 0x3f));
+                putchar(0x80 | (c & 0x3f));
+        }
+}
+`
+
+// the C statements run by input() when getchar hits the end of input,
+// pos is where the ',' is
+func (c *GenC) eof() string {
+	switch c.cfg.EOF {
+	case config.EOFMinusOne:
+		return "*c = -1;"
+	case config.EOFUnchanged:
+		return ""
+	case config.EOFError:
+		return fmt.Sprintf("fprintf(stderr, \"%%s: %s\\n\", pos); exit(1);", config.ErrEOF)
+	default:
+		return "*c = 0;"
 	}
 }
 
@@ -36,60 +307,45 @@ func (c *GenC) generateSrc() ([]byte, error) {
 * sweetbbak
 */
 
+#define _GNU_SOURCE
 #include <stdio.h>
-char array[%d];
-int idx = 0;
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+/* cells are unsigned and wrap around */
+typedef uint%d_t cell;
+#define CELLS %d
+%s
+long idx = 0;
 
+static void input(cell *c, const char *pos) {
+        int ch = getchar();
+        if (ch != EOF) {
+                *c = ch;
+                return;
+        }
+        %s
+}
+%s
 int main(int argc, char *argv[]) {
         `
 
 	// add memory size to header
-	start = fmt.Sprintf(start, c.memsize)
+	output := ""
+	if c.cfg.UTF8 {
+		output = utf8Output
+	}
+	start = fmt.Sprintf(start, c.cfg.CellBits, c.memsize, tapes[c.cfg.Tape], c.eof(), output)
 	buf.WriteString(start)
 
-	// create a lexer based on input
-	l := lexer.New(c.input)
-
-	// actual program parsing
-	program := l.Tokens()
-
-	token_index := 0
-	for token_index < len(program) {
-		// the current token
-		tok := program[token_index]
-
-		switch tok.Type {
-		case lexer.INC_PTR:
-			buf.WriteString(fmt.Sprintf("  idx += %d;\n", tok.Repeat))
-		case lexer.DEC_PTR:
-			buf.WriteString(fmt.Sprintf("  idx -= %d;\n", tok.Repeat))
-		case lexer.INC_CELL:
-			buf.WriteString(fmt.Sprintf("  array[idx] += %d;\n", tok.Repeat))
-		case lexer.DEC_CELL:
-			buf.WriteString(fmt.Sprintf("  array[idx] -= %d;\n", tok.Repeat))
-		case lexer.OUTPUT:
-			buf.WriteString("   putchar(array[idx]);\n")
-		case lexer.INPUT:
-			buf.WriteString("   array[idx] = getchar();\n")
-		case lexer.LOOP_OPEN:
-			// optimize [-] which loops and decrements a cell until it is zero by just setting it to zero 0x00 explicitly
-			if token_index+2 < len(program) {
-				// - and ]
-				if program[token_index+1].Type == lexer.DEC_CELL && program[token_index+2].Type == lexer.LOOP_CLOSE {
-					buf.WriteString("   array[idx] = 0;")
-					token_index += 3
-					continue
-				}
-			}
-			buf.WriteString("   while ( array[idx] ) {\n")
-		case lexer.LOOP_CLOSE:
-			buf.WriteString("}\n")
-		default:
-			// token not handled, decide what to do here
-			// continue
-			return nil, fmt.Errorf("unhandled token: %s at index %d", tok.Type, token_index)
-		}
-		token_index++
+	// build and optimize the program
+	program, err := ir.Compile(c.input, c.passes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.writeBlock(&buf, program); err != nil {
+		return nil, err
 	}
 
 	// close the main func
@@ -99,28 +355,70 @@ int main(int argc, char *argv[]) {
 }
 
 func (c *GenC) compileSrc(cpath string) error {
+	cc, err := c.compiler()
+	if err != nil {
+		return err
+	}
+
+	flags := c.flags()
+	args := slices.Concat(cc[1:], flags, []string{"-o", c.output, cpath})
+
+	// static executables run anywhere, but plenty of systems don't have
+	// a static libc. when linking fails try again without -static, unless
+	// it was asked for. any other failure is reported as it is
+	if !slices.Contains(flags, "-static") {
+		var stderr bytes.Buffer
+		static := exec.Command(cc[0], slices.Concat(cc[1:], []string{"-static"}, flags, []string{"-o", c.output, cpath})...)
+		static.Stdout = os.Stdout
+		static.Stderr = &stderr
+
+		err := static.Run()
+		if err == nil {
+			return nil
+		}
+
+		if !linkError(stderr.String()) {
+			os.Stderr.Write(stderr.Bytes())
+			return err
+		}
+	}
 
-	gcc := exec.Command(
-		"gcc",
-		"-static",
-		"-O3",
-		"-s",
-		"-o", c.output,
-		cpath,
-	)
+	build := exec.Command(cc[0], args...)
 
-	gcc.Stdout = os.Stdout
-	gcc.Stderr = os.Stderr
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
 
-	return gcc.Run()
+	return build.Run()
 }
 
-func (c *GenC) Generate(input string, output string) error {
+// what gcc, clang and the linkers they run say when linking fails, as
+// opposed to the C not compiling
+var linkErrors = []string{
+	"ld returned",
+	"linker command failed",
+	"cannot find -l",
+}
+
+func linkError(stderr string) bool {
+	for _, s := range linkErrors {
+		if strings.Contains(stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// the C source for a brainfuck program, without compiling it
+func (c *GenC) Source(input string) ([]byte, error) {
 	c.input = input
+	return c.generateSrc()
+}
+
+func (c *GenC) Generate(input string, output string) error {
 	c.output = output
 	tmp := c.output + ".c"
 
-	b, err := c.generateSrc()
+	b, err := c.Source(input)
 	if err != nil {
 		return err
 	}
@@ -130,6 +428,10 @@ func (c *GenC) Generate(input string, output string) error {
 		return err
 	}
 
+	if !c.keep {
+		defer os.Remove(tmp)
+	}
+
 	err = c.compileSrc(tmp)
 	if err != nil {
 		return err
@@ -0,0 +1,83 @@
+package cgen
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestCompiler(t *testing.T) {
+	t.Setenv("CC", "ccache  gcc")
+	t.Setenv("CFLAGS", "-O2 -g")
+
+	c := New(1)
+	cc, err := c.compiler()
+	if err != nil || !slices.Equal(cc, []string{"ccache", "gcc"}) || !slices.Equal(c.flags(), []string{"-O2", "-g"}) {
+		t.Errorf("from the environment: got %q %q %v", cc, c.flags(), err)
+	}
+
+	// picking them wins over the environment
+	c.SetCompiler("clang", []string{"-O1"})
+	cc, err = c.compiler()
+	if err != nil || !slices.Equal(cc, []string{"clang"}) || !slices.Equal(c.flags(), []string{"-O1"}) {
+		t.Errorf("picked: got %q %q %v", cc, c.flags(), err)
+	}
+
+	t.Setenv("CC", "")
+	t.Setenv("CFLAGS", "")
+	c.SetCompiler("", nil)
+	if !slices.Equal(c.flags(), []string{"-O3", "-s"}) {
+		t.Errorf("default: got flags %q", c.flags())
+	}
+}
+
+// a compiler that writes its arguments to a log, one run per line, and
+// fails the way gcc does without a static libc. it fails to compile
+// altogether when the program is called broken.c
+const fakeCC = `#!/bin/sh
+log="$(dirname "$0")/log"
+echo "$@" >> "$log"
+case "$*" in
+*broken.c) echo "broken.c:1:1: error: expected ';'" >&2; exit 1 ;;
+*" -static "*) echo "/usr/bin/ld: cannot find -lc" >&2; echo "collect2: error: ld returned 1 exit status" >&2; exit 1 ;;
+esac
+`
+
+func TestStaticFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script for a compiler")
+	}
+
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "fakecc")
+	if err := os.WriteFile(fake, []byte(fakeCC), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(1)
+	c.SetCompiler(fake+" gcc", []string{"-O2"})
+	c.output = "a.out"
+
+	// the wrapper keeps its first argument, and -static goes after it
+	if err := c.compileSrc("prog.c"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "gcc -static -O2 -o a.out prog.c\ngcc -O2 -o a.out prog.c\n"
+	if b, _ := os.ReadFile(filepath.Join(dir, "log")); string(b) != want {
+		t.Errorf("link error: got runs\n%swant\n%s", b, want)
+	}
+
+	// a program that doesn't compile isn't compiled again
+	os.Remove(filepath.Join(dir, "log"))
+	if err := c.compileSrc("broken.c"); err == nil {
+		t.Error("broken.c compiled")
+	}
+
+	want = "gcc -static -O2 -o a.out broken.c\n"
+	if b, _ := os.ReadFile(filepath.Join(dir, "log")); string(b) != want {
+		t.Errorf("compile error: got runs\n%swant\n%s", b, want)
+	}
+}
@@ -0,0 +1,175 @@
+// the backends that turn a brainfuck program into something that runs.
+// each backend package registers itself here when it is imported, so the
+// command line only has to look them up by name
+package gen
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/ir"
+)
+
+type Generator interface {
+	// takes program input, and creates outfile. backends that run the
+	// program straight away ignore outpath
+	Generate(input string, outpath string) error
+}
+
+// backends that translate to another language can hand the translation
+// back instead of compiling it
+type Emitter interface {
+	// the translated program, exactly what Generate would compile
+	Source(input string) ([]byte, error)
+}
+
+// what a backend can do, more than one can be set
+type Capability int
+
+const (
+	// writes an executable to the output path, which --run can start
+	Executable Capability = 1 << iota
+	// runs the program in process, reading Options.Input and writing
+	// Options.Output
+	InProcess
+	// can stop a program early with Options.MaxSteps and Options.Timeout
+	Limits
+	// calls out to a compiler or assembler that has to be installed
+	Toolchain
+	// its generator is an Emitter, so the translation can be written out
+	Source
+)
+
+var capabilityNames = []struct {
+	c    Capability
+	name string
+}{
+	{Executable, "executable"},
+	{InProcess, "in-process"},
+	{Limits, "limits"},
+	{Toolchain, "toolchain"},
+	{Source, "source"},
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.c != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// everything a backend is set up with. backends use the parts that apply
+// to them and leave the rest, which their capabilities say
+type Options struct {
+	// number of cells on the tape
+	Cells uint
+	// optimizations to run before generating code
+	Passes *ir.PassManager
+	// how cells, the tape and ',' behave
+	Config config.Config
+	// where in process backends read and write
+	Input  io.Reader
+	Output io.Writer
+	// for backends with Limits, 0 is no limit
+	MaxSteps int
+	Timeout  time.Duration
+	// leave the translated source next to the executable instead of
+	// removing it once it is compiled
+	KeepSource bool
+	// the C compiler and its flags, empty to use $CC and $CFLAGS
+	CC     string
+	CFlags []string
+}
+
+type Backend struct {
+	Name string
+	// other names the backend can be picked with
+	Aliases []string
+	// one line for --list-backends
+	Description string
+	Caps        Capability
+	// set up a generator with the given options
+	New func(Options) Generator
+}
+
+// whether the backend has every capability in c
+func (b Backend) Has(c Capability) bool {
+	return b.Caps&c == c
+}
+
+var backends []Backend
+
+// make a backend available to Lookup. it panics if the name or an alias
+// is already taken, since that can only be a mistake in the code
+func Register(b Backend) {
+	for _, name := range append([]string{b.Name}, b.Aliases...) {
+		if _, ok := find(name); ok {
+			panic(fmt.Sprintf("gen: backend %q registered twice", name))
+		}
+	}
+
+	backends = append(backends, b)
+}
+
+// the backend with exactly this name or alias
+func find(name string) (Backend, bool) {
+	for _, b := range backends {
+		if b.Name == name || slices.Contains(b.Aliases, name) {
+			return b, true
+		}
+	}
+	return Backend{}, false
+}
+
+// find a backend by its name or an alias, ignoring case. the start of a
+// name or alias picks it too as long as no other backend starts the same
+// way, so "i" works for interp
+func Lookup(name string) (Backend, error) {
+	name = strings.ToLower(name)
+	if name == "" {
+		return Backend{}, fmt.Errorf("no backend given, see --list-backends")
+	}
+
+	if b, ok := find(name); ok {
+		return b, nil
+	}
+
+	var found []Backend
+	for _, b := range backends {
+		for _, n := range append([]string{b.Name}, b.Aliases...) {
+			if strings.HasPrefix(n, name) {
+				found = append(found, b)
+				break
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return Backend{}, fmt.Errorf("unknown backend %q, see --list-backends", name)
+	case 1:
+		return found[0], nil
+	default:
+		var names []string
+		for _, b := range found {
+			names = append(names, b.Name)
+		}
+		return Backend{}, fmt.Errorf("backend %q could be any of %s", name, strings.Join(names, ", "))
+	}
+}
+
+// every registered backend, sorted by name
+func Backends() []Backend {
+	list := slices.Clone(backends)
+	slices.SortFunc(list, func(a, b Backend) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
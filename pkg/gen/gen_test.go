@@ -0,0 +1,42 @@
+package gen
+
+import "testing"
+
+func TestLookup(t *testing.T) {
+	saved := backends
+	defer func() { backends = saved }()
+
+	backends = nil
+	Register(Backend{Name: "interp", Aliases: []string{"interpreter"}})
+	Register(Backend{Name: "jit"})
+	Register(Backend{Name: "go", Aliases: []string{"golang"}})
+	Register(Backend{Name: "gcc"})
+
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"interp", "interp"},
+		{"Interpreter", "interp"},
+		{"i", "interp"},
+		{"j", "jit"},
+		// exact names win over prefixes
+		{"go", "go"},
+		{"gola", "go"},
+		// g could be go or gcc
+		{"g", ""},
+		{"", ""},
+		{"x", ""},
+	} {
+		b, err := Lookup(tc.name)
+		if b.Name != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%q: got %q, %v want %q", tc.name, b.Name, err, tc.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice didn't panic")
+		}
+	}()
+	Register(Backend{Name: "golang"})
+}
@@ -7,24 +7,208 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
 	"bfcc/pkg/lexer"
 )
 
-type Generator interface {
-	// takes program input, and creates outfile
-	Generate(input string, outpath string) error
-}
-
 type GolangGen struct {
 	input   string
 	output  string
 	memsize uint
+	passes  *ir.PassManager
+	cfg     config.Config
+	// leave the Go source behind after compiling it
+	keep bool
+}
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "go",
+		Aliases:     []string{"golang"},
+		Description: "Go compiled with the go tool",
+		Caps:        gen.Executable | gen.Toolchain | gen.Source,
+		New: func(o gen.Options) gen.Generator {
+			g := New(o.Cells)
+			g.SetPasses(o.Passes)
+			g.SetConfig(o.Config)
+			g.SetKeepSource(o.KeepSource)
+			return g
+		},
+	})
 }
 
 func New(memsize uint) *GolangGen {
 	return &GolangGen{
 		memsize: memsize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before generating code
+func (g *GolangGen) SetPasses(pm *ir.PassManager) {
+	g.passes = pm
+}
+
+// choose how cells behave
+func (g *GolangGen) SetConfig(cfg config.Config) {
+	g.cfg = cfg
+}
+
+// keep the generated Go file next to the executable, it is removed
+// once compiled otherwise
+func (g *GolangGen) SetKeepSource(keep bool) {
+	g.keep = keep
+}
+
+// the operator and constant that add n to a cell. Go won't let a constant
+// overflow the cell type, so it is wrapped into range first
+func (g *GolangGen) addend(n int) (string, uint64) {
+	if n < 0 {
+		return "-=", g.cfg.Wrap(-n)
+	}
+	return "+=", g.cfg.Wrap(n)
+}
+
+// the Go expression for the cell at offset from the pointer, pos is
+// reported if the cell isn't on the tape
+func cell(offset int, pos lexer.Position) string {
+	switch {
+	case offset > 0:
+		return fmt.Sprintf("*at(idx+%d, \"%s\")", offset, pos)
+	case offset < 0:
+		return fmt.Sprintf("*at(idx-%d, \"%s\")", -offset, pos)
+	default:
+		return fmt.Sprintf("*at(idx, \"%s\")", pos)
+	}
+}
+
+// how each kind of tape is declared and how at() finds a cell on it
+var tapes = map[config.Tape]string{
+	config.TapeFixed: `
+var array [cells]cell
+
+func at(i int, pos string) *cell {
+	if uint(i) >= cells {
+		out.Flush()
+		os.Stderr.WriteString(pos + ": ` + config.OutOfRange + `\n")
+		os.Exit(1)
+	}
+	return &array[i]
+}
+`,
+	config.TapeWrap: `
+var array [cells]cell
+
+func at(i int, pos string) *cell {
+	i %= cells
+	if i < 0 {
+		i += cells
+	}
+	return &array[i]
+}
+`,
+	config.TapeGrow: `
+var tape = make([]cell, cells)
+
+// index into tape of cell 0, there can be cells to the left of it
+var origin int
+
+func at(i int, pos string) *cell {
+	if i+origin < 0 || i+origin >= len(tape) {
+		grow(i, pos)
+	}
+	return &tape[i+origin]
+}
+
+// the tape grows no further than this either way
+const maxGrow = ` + strconv.Itoa(config.MaxGrow) + `
+
+// make room for cell i, at least doubling the tape
+func grow(i int, pos string) {
+	if i < -maxGrow || i >= maxGrow {
+		out.Flush()
+		os.Stderr.WriteString(pos + ": ` + config.OutOfRange + `\n")
+		os.Exit(1)
+	}
+
+	lo, hi := -origin, len(tape)-origin
+	for i < lo || i >= hi {
+		if i < lo {
+			lo = max(lo-(hi-lo), -maxGrow)
+		} else {
+			hi = min(hi+(hi-lo), maxGrow)
+		}
+	}
+
+	t := make([]cell, hi-lo)
+	copy(t[-origin-lo:], tape)
+	tape = t
+	origin = -lo
+}
+`,
+}
+
+func (g *GolangGen) writeBlock(buf *bytes.Buffer, block []*ir.Instr) error {
+	for _, in := range block {
+		switch in.Op {
+		case ir.Move:
+			if in.Arg < 0 {
+				buf.WriteString(fmt.Sprintf("  idx -= %d\n", -in.Arg))
+			} else {
+				buf.WriteString(fmt.Sprintf("  idx += %d\n", in.Arg))
+			}
+		case ir.Add:
+			op, n := g.addend(in.Arg)
+			buf.WriteString(fmt.Sprintf("  %s %s %d\n", cell(in.Offset, in.Pos), op, n))
+		case ir.Set:
+			buf.WriteString(fmt.Sprintf("  %s = %d\n", cell(in.Offset, in.Pos), g.cfg.Wrap(in.Arg)))
+		case ir.MulAdd:
+			op, n := g.addend(in.Arg)
+			// the source is read first, finding the destination can grow
+			// the tape and move the cells around
+			buf.WriteString(fmt.Sprintf("  {\n  s := %s\n  %s %s s * %d\n}\n", cell(in.Src, in.Pos), cell(in.Offset, in.Pos), op, n))
+		case ir.Output:
+			if g.cfg.UTF8 {
+				buf.WriteString(fmt.Sprintf("   output(%s)\n", cell(in.Offset, in.Pos)))
+			} else {
+				buf.WriteString(fmt.Sprintf("   out.WriteByte(byte(%s))\n", cell(in.Offset, in.Pos)))
+			}
+		case ir.Input:
+			buf.WriteString(fmt.Sprintf("   input(&%s, \"%s\")\n", cell(in.Offset, in.Pos), in.Pos))
+		case ir.Scan:
+			buf.WriteString(fmt.Sprintf("   for %s != 0 {\n  idx += %d\n}\n", cell(0, in.Pos), in.Arg))
+		case ir.Loop:
+			buf.WriteString(fmt.Sprintf("   for %s != 0 {\n", cell(0, in.Pos)))
+			if err := g.writeBlock(buf, in.Body); err != nil {
+				return err
+			}
+			buf.WriteString("}\n")
+		default:
+			// instruction not handled, decide what to do here
+			return fmt.Errorf("unhandled instruction: %s", in)
+		}
+	}
+
+	return nil
+}
+
+// the Go statements run by input() at the end of input, pos is where
+// the ',' is
+func (g *GolangGen) eof() string {
+	switch g.cfg.EOF {
+	case config.EOFMinusOne:
+		return "*c = ^cell(0)"
+	case config.EOFUnchanged:
+		return ""
+	case config.EOFError:
+		return fmt.Sprintf("os.Stderr.WriteString(pos + %q)\n\t\tos.Exit(1)", ": "+config.ErrEOF.Error()+"\n")
+	default:
+		return "*c = 0"
 	}
 }
 
@@ -38,92 +222,70 @@ func (g *GolangGen) generateSrc() ([]byte, error) {
 package main
 
 import (
+	"bufio"
+	"io"
 	"os"
 )
 
-var array [%d]int
+// cells are unsigned and wrap around
+type cell = uint%[2]d
+
+const cells = %[1]d
+%[4]s
 var idx int
 
-func main() {
+// output is buffered, and flushed before reading input or exiting
+var out = bufio.NewWriter(os.Stdout)
 
-	inputFn := func() int {
-		buf := make([]byte, 1)
-		b, err := os.Stdin.Read(buf)
-		if err != nil {
-		    panic(err)
-		}
+// write a cell as UTF-8, anything that isn't a code point is written
+// as U+FFFD
+func output(c cell) {
+	r := rune(0xfffd)
+	if uint64(c) <= 0x10ffff {
+		r = rune(c)
+	}
+	out.WriteRune(r)
+}
 
-		if b != 1 {
-		    panic("byte not read")
-		}
+func input(c *cell, pos string) {
+	out.Flush()
+
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(os.Stdin, buf)
+	if err == io.EOF {
+		%[3]s
+		return
+	}
 
-		return int(buf[0])
+	if err != nil {
+		os.Stderr.WriteString(pos + ": " + err.Error() + "\n")
+		os.Exit(1)
 	}
-	
-	var b int
-	
+
+	*c = cell(buf[0])
+}
+
+func main() {
 	// ignore unused
-	_ = b
-	_ = inputFn
+	_ = input
 `
 
 	// add memory size to header
-	start = fmt.Sprintf(start, g.memsize)
+	start = fmt.Sprintf(start, g.memsize, g.cfg.CellBits, g.eof(), tapes[g.cfg.Tape])
 	buf.WriteString(start)
 
-	// create a lexer based on input
-	l := lexer.New(g.input)
-
-	// actual program parsing
-	program := l.Tokens()
-
-	token_index := 0
-	for token_index < len(program) {
-		// the current token
-		tok := program[token_index]
-
-		switch tok.Type {
-		case lexer.INC_PTR:
-			buf.WriteString(fmt.Sprintf("  idx += %d\n", tok.Repeat))
-		case lexer.DEC_PTR:
-			buf.WriteString(fmt.Sprintf("  idx -= %d\n", tok.Repeat))
-		case lexer.INC_CELL:
-			buf.WriteString(fmt.Sprintf("  array[idx] += %d\n", tok.Repeat))
-		case lexer.DEC_CELL:
-			buf.WriteString(fmt.Sprintf("  array[idx] -= %d\n", tok.Repeat))
-		case lexer.OUTPUT:
-			buf.WriteString("   os.Stdout.Write([]byte{byte(array[idx])})\n")
-
-		case lexer.INPUT:
-			str := `
-			b = inputFn()
-			array[idx] = b
-`
-			buf.WriteString(str)
-		case lexer.LOOP_OPEN:
-			// optimize [-] which loops and decrements a cell until it is zero by just setting it to zero 0x00 explicitly
-			if token_index+2 < len(program) {
-				// - and ]
-				if program[token_index+1].Type == lexer.DEC_CELL && program[token_index+2].Type == lexer.LOOP_CLOSE {
-					buf.WriteString("   array[idx] = 0\n")
-					token_index += 3
-					continue
-				}
-			}
+	// build and optimize the program
+	program, err := ir.Compile(g.input, g.passes)
+	if err != nil {
+		return nil, err
+	}
 
-			buf.WriteString("   for array[idx] != 0 {\n")
-		case lexer.LOOP_CLOSE:
-			buf.WriteString("}\n")
-		default:
-			// token not handled, decide what to do here
-			// continue
-			return nil, fmt.Errorf("unhandled token: %s at index %d", tok.Type, token_index)
-		}
-		token_index++
+	if err := g.writeBlock(&buf, program); err != nil {
+		return nil, err
 	}
 
 	// close the main func
-	buf.WriteString("}\n")
+	buf.WriteString("  out.Flush()\n}\n")
 
 	return buf.Bytes(), nil
 }
@@ -145,12 +307,17 @@ func (g *GolangGen) compileSrc(cpath string) error {
 	return go_build.Run()
 }
 
-func (g *GolangGen) Generate(input string, output string) error {
+// the Go source for a brainfuck program, without compiling it
+func (g *GolangGen) Source(input string) ([]byte, error) {
 	g.input = input
+	return g.generateSrc()
+}
+
+func (g *GolangGen) Generate(input string, output string) error {
 	g.output = output
 	tmp := g.output + ".go"
 
-	b, err := g.generateSrc()
+	b, err := g.Source(input)
 	if err != nil {
 		return err
 	}
@@ -160,6 +327,10 @@ func (g *GolangGen) Generate(input string, output string) error {
 		return err
 	}
 
+	if !g.keep {
+		defer os.Remove(tmp)
+	}
+
 	err = g.compileSrc(tmp)
 	if err != nil {
 		return err
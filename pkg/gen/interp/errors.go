@@ -0,0 +1,118 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/lexer"
+)
+
+// what went wrong while running a program
+type ErrorKind int
+
+const (
+	// the pointer went left of the first cell of a fixed tape, or more
+	// than config.MaxGrow cells left on a growing one
+	PointerUnderflow ErrorKind = iota
+	// the pointer went right of the last cell of a fixed tape, or as far
+	// right as config.MaxGrow on a growing one
+	PointerOverflow
+	// ',' couldn't read, either a failing reader or the end of input
+	// with --eof=error
+	InputFailure
+	// the program ran more instructions than it was allowed to
+	StepLimit
+	// the context was cancelled or its deadline passed
+	Canceled
+)
+
+// the Err of a StepLimit RuntimeError
+var ErrStepLimit = errors.New("step limit reached")
+
+func (k ErrorKind) String() string {
+	switch k {
+	case PointerUnderflow:
+		return "pointer underflow"
+	case PointerOverflow:
+		return "pointer overflow"
+	case InputFailure:
+		return "input failure"
+	case StepLimit:
+		return "step limit"
+	case Canceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// how many cells either side of the pointer are kept in a RuntimeError
+const window = 8
+
+// a program failing while it runs, as opposed to a lexer.SyntaxError
+// which stops it from running at all
+type RuntimeError struct {
+	Kind ErrorKind
+	// index of the instruction that failed, at -O0 every token is its
+	// own instruction so this is also the index of the token
+	Index int
+	// where in the source the instruction came from
+	Pos lexer.Position
+	// the brainfuck pointer, and the cell the instruction wanted which
+	// can be some way off the pointer once offsets are folded in
+	Ptr  int
+	Cell int
+	// a copy of the cells around the pointer, Memory[0] is cell Start
+	Memory []uint64
+	Start  int
+	// the underlying problem, such as config.ErrEOF, ErrStepLimit or
+	// the context's error
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	switch {
+	case e.Kind == PointerUnderflow || e.Kind == PointerOverflow:
+		return fmt.Sprintf("%s: %s", e.Pos, config.OutOfRange)
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+	default:
+		return fmt.Sprintf("%s: %s", e.Pos, e.Kind)
+	}
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// build a RuntimeError for the current instruction, which wanted cell
+func (v *Interpreter) fail(kind ErrorKind, cell int, err error) *RuntimeError {
+	e := &RuntimeError{
+		Kind: kind,
+		Ptr:  v.ptr,
+		Cell: cell,
+		Err:  err,
+	}
+
+	if v.offset < len(v.code) {
+		e.Index = v.offset
+		e.Pos = v.code[v.offset].pos
+	}
+
+	// the window is centred on the pointer but only holds cells that
+	// are actually on the tape
+	at := v.ptr + v.origin
+	if v.cfg.Tape == config.TapeWrap {
+		at, _ = v.reach(v.ptr)
+	}
+
+	lo := max(at-window, 0)
+	hi := min(at+window+1, len(v.Memory))
+	if lo < hi {
+		e.Memory = append([]uint64(nil), v.Memory[lo:hi]...)
+	}
+	e.Start = lo - v.origin
+
+	return e
+}
@@ -1,53 +1,206 @@
 package interp
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"time"
 
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
 	"bfcc/pkg/lexer"
 )
 
+// loops are flattened into a pair of instructions that jump to each other
+const (
+	opOpen ir.Op = iota + 100
+	opClose
+)
+
+// a flattened ir instruction
+type inst struct {
+	op     ir.Op
+	arg    int
+	offset int
+	src    int
+	// index of the matching opOpen or opClose
+	jump int
+	// where in the source the instruction came from
+	pos lexer.Position
+}
+
 type Interpreter struct {
-	// the programs tokens
-	Tokens []*lexer.Token
+	// the programs instructions
+	code []inst
 	// out programs memory / tape
-	Memory []int
+	Memory []uint64
 	// usually stdin, for ',' read instruction
 	Input io.Reader
 	// usually stdout, for writing to
 	Output io.Writer
-	// our position in the tokens
+	// buffers Output while a program runs
+	out *bufio.Writer
+	// our position in the instructions
 	offset int
 	// brainfuck pointer
 	ptr int
 	// repl
 	repl *lexer.Lexer
+	// optimizations to run before interpreting
+	passes *ir.PassManager
+	// how cells behave
+	cfg config.Config
+	// cells are kept to these bits after every change
+	mask uint64
+	// index into Memory of cell 0, growing tapes can have cells left of it
+	origin int
+	// instructions run so far, and the most that are allowed (0 is no limit)
+	steps    int
+	maxSteps int
+	// steps at which the context and step limit are next looked at
+	check int
+	// how long Generate lets a program run for, 0 is no limit
+	timeout time.Duration
+}
+
+// how many instructions run between looking at the context, looking at
+// it every instruction would slow everything down a lot
+const checkEvery = 1 << 12
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "interp",
+		Aliases:     []string{"interpreter"},
+		Description: "interpreted straight away, which can limit how long a program runs for",
+		Caps:        gen.InProcess | gen.Limits,
+		New: func(o gen.Options) gen.Generator {
+			vm := New(int(o.Cells))
+			vm.SetPasses(o.Passes)
+			vm.SetConfig(o.Config)
+			vm.SetMaxSteps(o.MaxSteps)
+			vm.SetTimeout(o.Timeout)
+			vm.Input = o.Input
+			vm.Output = o.Output
+			return vm
+		},
+	})
 }
 
 // get a new interactive brainfuck Virtual Machine
 func New(stacksize int) *Interpreter {
 	vm := &Interpreter{
-		Memory: make([]int, stacksize),
+		Memory: make([]uint64, stacksize),
 		ptr:    0,
+		passes: ir.Default(),
 	}
+	vm.SetConfig(config.Default())
 
 	return vm
 }
 
+// choose which optimization passes run before interpreting
+func (v *Interpreter) SetPasses(pm *ir.PassManager) {
+	v.passes = pm
+}
+
+// choose how cells behave
+func (v *Interpreter) SetConfig(cfg config.Config) {
+	v.cfg = cfg
+	v.mask = cfg.Mask()
+}
+
+// stop programs after n instructions with a StepLimit error, 0 lets them
+// run forever. with optimizations on an instruction can stand for many
+// brainfuck characters, and every cell a scan loop moves over is a step
+func (v *Interpreter) SetMaxSteps(n int) {
+	v.maxSteps = n
+}
+
+// stop programs run with Generate after d with a Canceled error, 0 lets
+// them run forever. RunContext uses the context's deadline instead
+func (v *Interpreter) SetTimeout(d time.Duration) {
+	v.timeout = d
+}
+
+// turn the instruction tree into a flat list, resolving where every
+// loop jumps to up front so it doesn't have to be searched for at runtime
+func flatten(prog []*ir.Instr, code []inst) []inst {
+	for _, in := range prog {
+		if in.Op != ir.Loop {
+			code = append(code, inst{op: in.Op, arg: in.Arg, offset: in.Offset, src: in.Src, pos: in.Pos})
+			continue
+		}
+
+		open := len(code)
+		code = append(code, inst{op: opOpen, pos: in.Pos})
+		code = flatten(in.Body, code)
+		code = append(code, inst{op: opClose, jump: open, pos: in.Pos})
+		code[open].jump = len(code) - 1
+	}
+
+	return code
+}
+
 // interpret an entire brainfuck program
 func (v *Interpreter) Generate(input string, output string) error {
-	l := lexer.New(input)
+	ctx := context.Background()
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+
+	return v.RunContext(ctx, input)
+}
 
-	tok := l.Next()
-	for tok.Type != lexer.EOF {
-		v.Tokens = append(v.Tokens, tok)
-		tok = l.Next()
+// interpret an entire brainfuck program, stopping with a Canceled error
+// once ctx is done, so a deadline on ctx limits how long it can run for
+func (v *Interpreter) RunContext(ctx context.Context, input string) error {
+	prog, err := ir.Compile(input, v.passes)
+	if err != nil {
+		return err
 	}
 
+	return v.RunProgram(ctx, prog)
+}
+
+// interpret a program that has already been compiled. the passes set with
+// SetPasses aren't run, prog is left as it is so it can be run again
+func (v *Interpreter) RunProgram(ctx context.Context, prog []*ir.Instr) error {
+	v.code = flatten(prog, nil)
 	v.ptr = 0
 	v.offset = 0
 
-	for v.offset < len(v.Tokens) {
+	return v.run(ctx)
+}
+
+// run the loaded instructions from the start. output is buffered, and
+// flushed before reading input and when the program stops
+func (v *Interpreter) run(ctx context.Context) (err error) {
+	v.steps = 0
+	v.check = 0
+
+	if v.Output == nil {
+		v.Output = io.Discard
+	}
+	v.out = bufio.NewWriter(v.Output)
+
+	defer func() {
+		if ferr := v.out.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+
+	for v.offset < len(v.code) {
+		if v.steps >= v.check {
+			if err := v.checkpoint(ctx); err != nil {
+				return err
+			}
+		}
+
+		v.steps++
 		err := v.evaluate()
 		if err != nil {
 			return err
@@ -57,15 +210,35 @@ func (v *Interpreter) Generate(input string, output string) error {
 	return nil
 }
 
+// see whether the program has to stop, and when to look again
+func (v *Interpreter) checkpoint(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return v.fail(Canceled, v.ptr, err)
+	}
+
+	if v.maxSteps > 0 && v.steps >= v.maxSteps {
+		return v.fail(StepLimit, v.ptr, ErrStepLimit)
+	}
+
+	v.check = v.steps + checkEvery
+	if v.maxSteps > 0 {
+		v.check = min(v.check, v.maxSteps)
+	}
+
+	return nil
+}
+
 // get a new interactive brainfuck repl
 func NewRepl(stacksize int) *Interpreter {
 	l := lexer.Repl()
 
 	vm := &Interpreter{
-		Memory: make([]int, stacksize),
+		Memory: make([]uint64, stacksize),
 		ptr:    0,
 		repl:   l,
+		passes: ir.Default(),
 	}
+	vm.SetConfig(config.Default())
 
 	return vm
 }
@@ -83,95 +256,152 @@ func (v *Interpreter) Eval(instruction string) error {
 		return fmt.Errorf("repl has not been initialized")
 	}
 
-	tokens := v.repl.Read(instruction)
-	v.Tokens = tokens
+	tokens, err := v.repl.Read(instruction)
+	if err != nil {
+		return err
+	}
+
+	prog, err := ir.Build(tokens)
+	if err != nil {
+		return err
+	}
+
+	v.code = flatten(v.passes.Run(prog), nil)
 	v.offset = 0
-	v.repl.Zero()
 
-	for v.offset < len(v.Tokens) {
-		err := v.evaluate()
-		if err != nil {
-			return err
+	return v.run(context.Background())
+}
+
+// read a byte of input into cell i, following the configured eof
+// behaviour when there is none left
+func (v *Interpreter) read(i int) error {
+	// anyone waiting for a prompt gets it before the program waits
+	if err := v.out.Flush(); err != nil {
+		return err
+	}
+
+	var err error
+	v.Memory[i], err = v.cfg.ReadCell(v.Input, v.Memory[i])
+	return err
+}
+
+// the index into Memory of cell i, ok is false if a fixed tape doesn't
+// have the cell or a growing one can't grow that far. kept small so it
+// is inlined for fixed tapes
+func (v *Interpreter) cell(i int) (idx int, ok bool) {
+	if v.cfg.Tape == config.TapeFixed {
+		return i, uint(i) < uint(len(v.Memory))
+	}
+	return v.reach(i)
+}
+
+// growing tapes are extended to fit cell i and wrapping tapes bring it
+// back around
+func (v *Interpreter) reach(i int) (int, bool) {
+	if v.cfg.Tape == config.TapeWrap {
+		i %= len(v.Memory)
+		if i < 0 {
+			i += len(v.Memory)
 		}
+		return i, true
 	}
 
-	return nil
+	if i+v.origin < 0 || i+v.origin >= len(v.Memory) {
+		var ok bool
+		if v.Memory, v.origin, ok = config.Grow(v.Memory, v.origin, i); !ok {
+			return 0, false
+		}
+	}
+	return i + v.origin, true
+}
+
+// the error for the tape not having cell i
+func (v *Interpreter) outOfRange(i int) error {
+	if i < 0 {
+		return v.fail(PointerUnderflow, i, nil)
+	}
+	return v.fail(PointerOverflow, i, nil)
 }
 
 // evaluate the current instruction
 func (v *Interpreter) evaluate() error {
-	tok := v.Tokens[v.offset]
-	switch tok.Type {
-
-	case lexer.INC_PTR:
-		v.ptr += tok.Repeat
+	in := v.code[v.offset]
+
+	// the cell being worked on, and the loop cell for loops and scans
+	var c int
+	if in.op != ir.Move {
+		var ok bool
+		if c, ok = v.cell(v.ptr + in.offset); !ok {
+			return v.outOfRange(v.ptr + in.offset)
+		}
+	}
 
-	case lexer.DEC_PTR:
-		v.ptr -= tok.Repeat
+	switch in.op {
 
-	case lexer.INC_CELL:
-		v.Memory[v.ptr] += tok.Repeat
+	case ir.Move:
+		v.ptr += in.arg
 
-	case lexer.DEC_CELL:
-		v.Memory[v.ptr] -= tok.Repeat
+	case ir.Add:
+		v.Memory[c] = (v.Memory[c] + uint64(in.arg)) & v.mask
 
-	case lexer.OUTPUT:
-		fmt.Fprintf(v.Output, "%c", rune(v.Memory[v.ptr]))
+	case ir.Set:
+		v.Memory[c] = uint64(in.arg) & v.mask
 
-	case lexer.INPUT:
-		buf := make([]byte, 1)
-		b, err := v.Input.Read(buf)
-		if err != nil {
-			return err
+	case ir.MulAdd:
+		src, ok := v.cell(v.ptr + in.src)
+		if !ok {
+			return v.outOfRange(v.ptr + in.src)
 		}
 
-		if b != 1 {
-			return fmt.Errorf("read %d bytes of input, not 1", b)
-		}
+		// growing for the source may have moved the tape
+		c, _ = v.cell(v.ptr + in.offset)
+		v.Memory[c] = (v.Memory[c] + v.Memory[src]*uint64(in.arg)) & v.mask
+
+	case ir.Scan:
+		for v.Memory[c] != 0 {
+			// a scan on a wrapping tape with no zero cells never ends,
+			// so hand back to run every so often without moving on.
+			// running the scan again carries on from where it got to
+			if v.steps >= v.check {
+				return nil
+			}
+			v.steps++
+			v.ptr += in.arg
 
-		v.Memory[v.ptr] = int(buf[0])
-	case lexer.LOOP_OPEN:
-		// advance if our loop counter is not 0 (which is when we stop looping)
-		if v.Memory[v.ptr] != 0 {
-			v.offset++
-			return nil
+			var ok bool
+			if c, ok = v.cell(v.ptr); !ok {
+				return v.outOfRange(v.ptr)
+			}
 		}
 
-		// counting the depth of our loops (they are often deeply nested)
-		depth := 1
-		for depth != 0 {
-			v.offset++
-			switch v.Tokens[v.offset].Type {
-			case lexer.LOOP_OPEN:
-				depth++
-			case lexer.LOOP_CLOSE:
-				depth--
-			}
+	case ir.Output:
+		var err error
+		if v.cfg.UTF8 {
+			_, err = v.out.WriteRune(config.Rune(v.Memory[c]))
+		} else {
+			err = v.out.WriteByte(byte(v.Memory[c]))
 		}
 
-		return nil
+		if err != nil {
+			return err
+		}
 
-	case lexer.LOOP_CLOSE:
-		// if our loop is over, move on
-		if v.Memory[v.ptr] == 0 {
-			v.offset++
-			return nil
+	case ir.Input:
+		if err := v.read(c); err != nil {
+			return v.fail(InputFailure, v.ptr+in.offset, err)
 		}
 
-		// counting the depth of our loops (they are often deeply nested)
-		// same as LOOP_OPEN but in reverse
-		depth := 1
-		for depth != 0 {
-			v.offset--
-			switch v.Tokens[v.offset].Type {
-			case lexer.LOOP_OPEN:
-				depth--
-			case lexer.LOOP_CLOSE:
-				depth++
-			}
+	case opOpen:
+		// skip past the loop if our loop counter is 0
+		if v.Memory[c] == 0 {
+			v.offset = in.jump
 		}
 
-		return nil
+	case opClose:
+		// go back to the start of the loop unless it is over
+		if v.Memory[c] != 0 {
+			v.offset = in.jump
+		}
 	}
 
 	// next instruction
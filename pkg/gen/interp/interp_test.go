@@ -0,0 +1,141 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/ir"
+)
+
+func TestRuntimeError(t *testing.T) {
+	for _, tc := range []struct {
+		src   string
+		kind  ErrorKind
+		index int
+		ptr   int
+		cell  int
+		start int
+	}{
+		{"+>+\n<<+", PointerUnderflow, 5, -1, -1, 0},
+		{"+[>+]", PointerOverflow, 3, 4, 4, 0},
+		{">>>,", InputFailure, 3, 3, 3, 0},
+	} {
+		vm := New(4)
+		vm.SetPasses(ir.NewPassManager())
+		vm.SetConfig(config.Config{CellBits: 8, EOF: config.EOFError})
+
+		var rerr *RuntimeError
+		if err := vm.Generate(tc.src, ""); !errors.As(err, &rerr) {
+			t.Fatalf("%q: got error %v, want a RuntimeError", tc.src, err)
+		}
+
+		if rerr.Kind != tc.kind || rerr.Index != tc.index || rerr.Ptr != tc.ptr || rerr.Cell != tc.cell || rerr.Start != tc.start {
+			t.Errorf("%q: got %+v", tc.src, rerr)
+		}
+
+		if !slices.Equal(rerr.Memory, vm.Memory) {
+			t.Errorf("%q: got window %v, want %v", tc.src, rerr.Memory, vm.Memory)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// scanning a wrapping tape with no zero cells goes on forever
+	vm := New(2)
+	vm.SetConfig(config.Config{CellBits: 8, Tape: config.TapeWrap})
+	vm.SetMaxSteps(100_000)
+
+	err := vm.Generate("+>+[>]", "")
+	if !errors.Is(err, ErrStepLimit) {
+		t.Errorf("steps: got error %v, want %v", err, ErrStepLimit)
+	}
+
+	// a program that finishes within the limit isn't stopped
+	vm = New(2)
+	vm.SetMaxSteps(5)
+	if err := vm.Generate("+++++", ""); err != nil {
+		t.Errorf("steps: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var rerr *RuntimeError
+	err = New(1).RunContext(ctx, "+[]")
+	if !errors.As(err, &rerr) || rerr.Kind != Canceled || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timeout: got error %v", err)
+	}
+}
+
+// an io.Reader that records what had been written when it was read
+type prompted struct {
+	out  *bytes.Buffer
+	seen []string
+}
+
+func (p *prompted) Read(b []byte) (int, error) {
+	p.seen = append(p.seen, p.out.String())
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestOutput(t *testing.T) {
+	var out bytes.Buffer
+	in := &prompted{out: &out}
+
+	// bytes above 127 are written as they are, not utf-8 encoded
+	vm := New(2)
+	vm.Input = in
+	vm.Output = &out
+	if err := vm.Generate("-.+++.,+.,", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "\xff\x02y"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	// output is all there before every read
+	if want := []string{"\xff\x02", "\xff\x02y"}; !slices.Equal(in.seen, want) {
+		t.Errorf("got %q before reading, want %q", in.seen, want)
+	}
+
+	// or as code points, with anything that isn't one replaced
+	out.Reset()
+	vm = New(2)
+	vm.SetConfig(config.Config{CellBits: 32, UTF8: true})
+	vm.Output = &out
+	if err := vm.Generate("-.+.>++++++++[<++++++++>-]<+.", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "\ufffd\x00A"; out.String() != want {
+		t.Errorf("utf8: got %q, want %q", out.String(), want)
+	}
+}
+
+func BenchmarkMandelbrot(b *testing.B) {
+	src, err := os.ReadFile(filepath.Join("..", "..", "..", "examples", "mandelbrot.bf"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		vm := New(30_000)
+		vm.Input = strings.NewReader("")
+		vm.Output = io.Discard
+
+		if err := vm.Generate(string(src), ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+#include "textflag.h"
+
+// func call(code uintptr, st unsafe.Pointer)
+//
+// jump into jitted code with the state pointer in DI. the code keeps
+// SP and BP intact, everything else is free to clobber in ABI0
+TEXT ·call(SB), NOSPLIT, $0-16
+	MOVQ code+0(FP), AX
+	MOVQ st+8(FP), DI
+	CALL AX
+	RET
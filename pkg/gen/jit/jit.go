@@ -0,0 +1,64 @@
+// this package compiles a brainfuck program to x86-64 machine code in
+// memory and runs it in process, getting close to compiled speed without
+// writing any files or calling gcc. only linux/amd64 is supported
+package jit
+
+import (
+	"io"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
+)
+
+type JIT struct {
+	// usually stdin, for ',' read instruction
+	Input io.Reader
+	// usually stdout, for writing to
+	Output io.Writer
+	// size of the tape
+	memsize int
+	// optimizations to run before compiling
+	passes *ir.PassManager
+	// how cells behave
+	cfg config.Config
+}
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "jit",
+		Description: "x86-64 machine code compiled in memory and run straight away (linux/amd64)",
+		Caps:        gen.InProcess,
+		New: func(o gen.Options) gen.Generator {
+			j := New(int(o.Cells))
+			j.SetPasses(o.Passes)
+			j.SetConfig(o.Config)
+			j.Input = o.Input
+			j.Output = o.Output
+			return j
+		},
+	})
+}
+
+func New(stacksize int) *JIT {
+	return &JIT{
+		memsize: stacksize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before compiling
+func (j *JIT) SetPasses(pm *ir.PassManager) {
+	j.passes = pm
+}
+
+// choose how cells behave
+func (j *JIT) SetConfig(cfg config.Config) {
+	j.cfg = cfg
+}
+
+// compile and run an entire brainfuck program, there is no output file
+func (j *JIT) Generate(input string, output string) error {
+	return j.Run(input)
+}
@@ -0,0 +1,220 @@
+package jit
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+	"bfcc/pkg/x86"
+)
+
+// implemented in call_linux_amd64.s
+func call(code uintptr, st unsafe.Pointer)
+
+// why the jitted code handed control back to go
+const (
+	reasonExit = iota
+	reasonOutput
+	reasonInput
+	reasonFault
+)
+
+// shared between go and the jitted code, the field offsets are baked
+// into the machine code so the layout must not change
+type state struct {
+	// address of the current cell
+	cell uintptr
+	// index of the resume point to continue from
+	resume uint64
+	// one of the reason constants
+	reason uint64
+	// address of the cell to do I/O on
+	addr uintptr
+	// the ends of the tape, loaded into TapeLo and TapeHi
+	lo, hi uintptr
+	// index of the position that used a cell off the tape
+	fault uint64
+}
+
+const (
+	offCell   = 0
+	offResume = 8
+	offReason = 16
+	offAddr   = 24
+	offLo     = 32
+	offHi     = 40
+	offFault  = 48
+)
+
+// callbacks is the runtime used by the jit, every ',' and '.' saves the
+// cell pointer and returns to go, which does the I/O and jumps back into
+// the code at the resume point right after the instruction
+type callbacks struct {
+	// offsets the code can be re-entered at, the entry point is index 0
+	resumes []int
+	// the instruction that handed control back before each resume point
+	where []lexer.Position
+	// positions of the instructions that report leaving the tape
+	faults []lexer.Position
+}
+
+// return to go with the given reason and the address of [base + disp],
+// then continue from a new resume point
+func (c *callbacks) yield(a *x86.Assembler, reason int32, base x86.Reg, disp int32, pos lexer.Position) {
+	a.Lea(x86.RAX, base, disp)
+	a.StoreReg(x86.RDI, offAddr, x86.RAX)
+	a.MovMemImm(x86.Qword, x86.RDI, offReason, reason)
+	a.MovMemImm(x86.Qword, x86.RDI, offResume, int32(len(c.resumes)))
+	a.StoreReg(x86.RDI, offCell, x86.CellReg)
+	a.Ret()
+
+	c.enter(a, pos)
+}
+
+// bind a new resume point which reloads the cell pointer and the tape
+func (c *callbacks) enter(a *x86.Assembler, pos lexer.Position) {
+	c.resumes = append(c.resumes, a.Len())
+	c.where = append(c.where, pos)
+	a.LoadReg(x86.CellReg, x86.RDI, offCell)
+	a.LoadReg(x86.TapeLo, x86.RDI, offLo)
+	a.LoadReg(x86.TapeHi, x86.RDI, offHi)
+}
+
+func (c *callbacks) Enter(a *x86.Assembler) {
+	c.enter(a, lexer.Position{})
+}
+
+func (c *callbacks) Output(a *x86.Assembler, base x86.Reg, disp int32) {
+	c.yield(a, reasonOutput, base, disp, lexer.Position{})
+}
+
+// go knows the cell size, so it can store the byte itself
+func (c *callbacks) Input(a *x86.Assembler, base x86.Reg, disp int32, w x86.Width, pos lexer.Position) {
+	c.yield(a, reasonInput, base, disp, pos)
+}
+
+func (c *callbacks) Exit(a *x86.Assembler) {
+	a.MovMemImm(x86.Qword, x86.RDI, offReason, reasonExit)
+	a.StoreReg(x86.RDI, offCell, x86.CellReg)
+	a.Ret()
+}
+
+// return to go for good, saying which instruction left the tape
+func (c *callbacks) Fault(a *x86.Assembler, pos lexer.Position) {
+	a.MovMemImm(x86.Qword, x86.RDI, offReason, reasonFault)
+	a.MovMemImm(x86.Qword, x86.RDI, offFault, int32(len(c.faults)))
+	a.Ret()
+
+	c.faults = append(c.faults, pos)
+}
+
+// compile and run an entire brainfuck program
+func (j *JIT) Run(input string) error {
+	program, err := ir.Compile(input, j.passes)
+	if err != nil {
+		return err
+	}
+
+	size := j.cfg.CellSize()
+	rt := &callbacks{}
+	layout := x86.Tape{Width: x86.Width(size), Mode: j.cfg.Tape, Cells: j.memsize}
+
+	code, err := x86.Compile(program, rt, layout)
+	if err != nil {
+		return err
+	}
+
+	// the code never changes after it is written so the page is mapped
+	// writable first and then flipped to executable
+	mem, err := syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return fmt.Errorf("mapping code: %w", err)
+	}
+	defer syscall.Munmap(mem)
+
+	copy(mem, code)
+	if err := syscall.Mprotect(mem, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return fmt.Errorf("protecting code: %w", err)
+	}
+
+	// the tape lives outside of the go heap so the code can hold on to it.
+	// a growing tape reserves plenty of address space and starts in the
+	// middle of it, pages are only really allocated once they are touched
+	length, flags := j.memsize*size, syscall.MAP_PRIVATE|syscall.MAP_ANON
+	if j.cfg.Tape == config.TapeGrow {
+		length, flags = x86.GrowReserve(x86.Width(size)), flags|syscall.MAP_NORESERVE
+	}
+
+	tape, err := syscall.Mmap(-1, 0, length, syscall.PROT_READ|syscall.PROT_WRITE, flags)
+	if err != nil {
+		return fmt.Errorf("mapping tape: %w", err)
+	}
+	defer syscall.Munmap(tape)
+
+	base := uintptr(unsafe.Pointer(&mem[0]))
+	lo := uintptr(unsafe.Pointer(&tape[0]))
+	st := &state{cell: lo, lo: lo, hi: lo + uintptr(len(tape))}
+	if j.cfg.Tape == config.TapeGrow {
+		st.cell = lo + uintptr(len(tape)/2)
+	}
+	out := make([]byte, 0, utf8.UTFMax)
+
+	for {
+		call(base+uintptr(rt.resumes[st.resume]), unsafe.Pointer(st))
+		ptr := int(st.addr - lo)
+
+		switch st.reason {
+		case reasonExit:
+			return nil
+
+		case reasonFault:
+			return fmt.Errorf("%s: %s", rt.faults[st.fault], config.OutOfRange)
+
+		case reasonOutput:
+			if err := j.write(tape[ptr:ptr+size], out); err != nil {
+				return err
+			}
+
+		case reasonInput:
+			if err := j.read(tape[ptr : ptr+size]); err != nil {
+				return fmt.Errorf("%s: %w", rt.where[st.resume], err)
+			}
+		}
+	}
+}
+
+// write a little endian cell as its low byte, or as UTF-8. buf is
+// somewhere to encode it that is reused between calls
+func (j *JIT) write(cell []byte, buf []byte) error {
+	if !j.cfg.UTF8 {
+		buf = append(buf[:0], cell[0])
+	} else {
+		var n uint64
+		for i := len(cell) - 1; i >= 0; i-- {
+			n = n<<8 | uint64(cell[i])
+		}
+		buf = utf8.AppendRune(buf[:0], config.Rune(n))
+	}
+
+	_, err := j.Output.Write(buf)
+	return err
+}
+
+// read a byte of input into a little endian cell, following the
+// configured eof behaviour when there is none left
+func (j *JIT) read(cell []byte) error {
+	var old uint64
+	for i := len(cell) - 1; i >= 0; i-- {
+		old = old<<8 | uint64(cell[i])
+	}
+
+	n, err := j.cfg.ReadCell(j.Input, old)
+	for i := range cell {
+		cell[i] = byte(n >> (8 * i))
+	}
+	return err
+}
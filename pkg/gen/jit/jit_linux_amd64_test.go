@@ -0,0 +1,58 @@
+package jit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestState(t *testing.T) {
+	// the jitted code finds the fields at these offsets
+	var st state
+	for _, f := range []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"cell", unsafe.Offsetof(st.cell), offCell},
+		{"resume", unsafe.Offsetof(st.resume), offResume},
+		{"reason", unsafe.Offsetof(st.reason), offReason},
+		{"addr", unsafe.Offsetof(st.addr), offAddr},
+		{"lo", unsafe.Offsetof(st.lo), offLo},
+		{"hi", unsafe.Offsetof(st.hi), offHi},
+		{"fault", unsafe.Offsetof(st.fault), offFault},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s is at %d, the code expects %d", f.name, f.got, f.want)
+		}
+	}
+}
+
+// an io.Reader that fails
+type failing struct{}
+
+var errRead = errors.New("read failed")
+
+func (failing) Read(b []byte) (int, error) {
+	return 0, errRead
+}
+
+func TestCallbacks(t *testing.T) {
+	// every ',' and '.' goes back to go and resumes right after itself
+	var out bytes.Buffer
+	j := New(1)
+	j.Input = strings.NewReader("hello")
+	j.Output = &out
+	if err := j.Generate(",[.,]+.", ""); err != nil || out.String() != "hello\x01" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+
+	// reading failing is reported where it happened
+	j = New(1)
+	j.Input = failing{}
+	j.Output = &bytes.Buffer{}
+	if err := j.Generate("+.\n,", ""); !errors.Is(err, errRead) || err.Error() != "2:1: read failed" {
+		t.Errorf("got error %v", err)
+	}
+}
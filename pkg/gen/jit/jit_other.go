@@ -0,0 +1,13 @@
+//go:build !(linux && amd64)
+
+package jit
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// compile and run an entire brainfuck program
+func (j *JIT) Run(input string) error {
+	return fmt.Errorf("the jit backend is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,78 @@
+package native
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+)
+
+const (
+	// where the kernel maps the start of our file
+	baseAddr = 0x400000
+	// where the zeroed tape is mapped, far enough away that the code
+	// never runs into it
+	tapeAddr = 0x10000000
+	pageSize = 0x1000
+
+	headerSize = 64
+	phdrSize   = 56
+	// the code directly follows the elf header and both program headers
+	codeOffset = headerSize + 2*phdrSize
+)
+
+// the most code that fits between the base address and the tape
+const maxCode = tapeAddr - baseAddr - codeOffset
+
+// build a static elf64 executable with two segments: the headers and
+// code (r-x), and a bss segment holding the tape (rw-)
+func writeELF(code []byte, memsize uint64) []byte {
+	var buf bytes.Buffer
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     baseAddr + codeOffset,
+		Phoff:     headerSize,
+		Ehsize:    headerSize,
+		Phentsize: phdrSize,
+		Phnum:     2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	hdr.Ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+
+	filesz := uint64(codeOffset + len(code))
+
+	text := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Off:    0,
+		Vaddr:  baseAddr,
+		Paddr:  baseAddr,
+		Filesz: filesz,
+		Memsz:  filesz,
+		Align:  pageSize,
+	}
+
+	bss := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_W),
+		Off:    0,
+		Vaddr:  tapeAddr,
+		Paddr:  tapeAddr,
+		Filesz: 0,
+		Memsz:  memsize,
+		Align:  pageSize,
+	}
+
+	// writes to a bytes.Buffer can't fail
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	binary.Write(&buf, binary.LittleEndian, text)
+	binary.Write(&buf, binary.LittleEndian, bss)
+	buf.Write(code)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,45 @@
+package native
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+)
+
+func TestELF(t *testing.T) {
+	code := []byte{0x0f, 0x05, 0xc3}
+
+	f, err := elf.NewFile(bytes.NewReader(writeELF(code, 30_000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Class != elf.ELFCLASS64 || f.Data != elf.ELFDATA2LSB || f.Type != elf.ET_EXEC || f.Machine != elf.EM_X86_64 {
+		t.Errorf("got a %s %s %s for %s", f.Class, f.Data, f.Type, f.Machine)
+	}
+
+	if f.Entry != baseAddr+codeOffset {
+		t.Errorf("got entry %#x, want %#x", f.Entry, baseAddr+codeOffset)
+	}
+
+	if len(f.Progs) != 2 {
+		t.Fatalf("got %d program headers, want 2", len(f.Progs))
+	}
+
+	// the file itself is mapped with the code at the end of it
+	text := f.Progs[0]
+	if text.Type != elf.PT_LOAD || text.Flags != elf.PF_R|elf.PF_X || text.Vaddr != baseAddr || text.Filesz != codeOffset+uint64(len(code)) {
+		t.Errorf("got text segment %+v", text.ProgHeader)
+	}
+
+	b := make([]byte, len(code))
+	if _, err := text.ReadAt(b, codeOffset); err != nil || !bytes.Equal(b, code) {
+		t.Errorf("got code % x, want % x", b, code)
+	}
+
+	// and the tape is zeroed memory that isn't in the file at all
+	bss := f.Progs[1]
+	if bss.Type != elf.PT_LOAD || bss.Flags != elf.PF_R|elf.PF_W || bss.Vaddr != tapeAddr || bss.Filesz != 0 || bss.Memsz != 30_000 {
+		t.Errorf("got tape segment %+v", bss.ProgHeader)
+	}
+}
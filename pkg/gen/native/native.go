@@ -0,0 +1,330 @@
+// this package handles turning a brainfuck program directly into a
+// static x86-64 linux ELF executable, no assembler, linker or libc needed
+package native
+
+import (
+	"fmt"
+	"os"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+	"bfcc/pkg/x86"
+)
+
+// linux x86-64 syscall numbers
+const (
+	sysRead  = 0
+	sysWrite = 1
+	sysMmap  = 9
+	sysExit  = 60
+)
+
+// mmap flags
+const (
+	protRead     = 0x1
+	protWrite    = 0x2
+	mapPrivate   = 0x02
+	mapAnonymous = 0x20
+	mapNoReserve = 0x4000
+)
+
+type GenNative struct {
+	input   string
+	output  string
+	memsize uint
+	passes  *ir.PassManager
+	cfg     config.Config
+}
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "native",
+		Aliases:     []string{"elf"},
+		Description: "a static x86-64 linux executable written directly, no toolchain needed",
+		Caps:        gen.Executable,
+		New: func(o gen.Options) gen.Generator {
+			g := New(o.Cells)
+			g.SetPasses(o.Passes)
+			g.SetConfig(o.Config)
+			return g
+		},
+	})
+}
+
+func New(memsize uint) *GenNative {
+	return &GenNative{
+		memsize: memsize,
+		passes:  ir.Default(),
+		cfg:     config.Default(),
+	}
+}
+
+// choose which optimization passes run before generating code
+func (n *GenNative) SetPasses(pm *ir.PassManager) {
+	n.passes = pm
+}
+
+// choose how cells behave
+func (n *GenNative) SetConfig(cfg config.Config) {
+	n.cfg = cfg
+}
+
+// syscalls is the runtime used by standalone executables
+type syscalls struct {
+	cfg config.Config
+	// size of the tape in bytes
+	size int64
+	// shared code that prints the message at rsi, rdx bytes long, and
+	// exits with 1. it is bound the first time it is needed
+	die     x86.Label
+	dieUsed bool
+	// out of line code reporting failing to map a growing tape
+	noTape   x86.Label
+	tapeUsed bool
+	// and reading past the end of input, one per position
+	eofs     map[lexer.Position]x86.Label
+	eofOrder []lexer.Position
+	// shared code writing the code point in rax as UTF-8
+	utf8     x86.Label
+	utf8Used bool
+}
+
+func (rt *syscalls) Enter(a *x86.Assembler) {
+	if rt.cfg.Tape != config.TapeGrow {
+		a.MovRegImm64(x86.CellReg, tapeAddr)
+		a.MovRegImm64(x86.TapeLo, tapeAddr)
+		a.MovRegImm64(x86.TapeHi, tapeAddr+rt.size)
+		return
+	}
+
+	// mmap(0, GrowReserve(w), PROT_READ|PROT_WRITE,
+	//      MAP_PRIVATE|MAP_ANONYMOUS|MAP_NORESERVE, -1, 0)
+	// and start in the middle, so there is room on both sides
+	rt.noTape = a.NewLabel()
+	rt.tapeUsed = true
+
+	a.MovRegImm32(x86.RAX, sysMmap)
+	a.XorRegReg(x86.RDI, x86.RDI)
+	reserve := x86.GrowReserve(x86.Width(rt.cfg.CellSize()))
+	a.MovRegImm64(x86.RSI, int64(reserve))
+	a.MovRegImm32(x86.RDX, protRead|protWrite)
+	a.MovRegImm32(x86.R10, mapPrivate|mapAnonymous|mapNoReserve)
+	a.MovRegImm64(x86.R8, -1)
+	a.XorRegReg(x86.R9, x86.R9)
+	a.Syscall()
+
+	a.TestRegReg(x86.RAX, x86.RAX)
+	a.Jcc(x86.CondL, rt.noTape)
+
+	a.MovRegReg(x86.TapeLo, x86.RAX)
+	a.MovRegImm64(x86.TapeHi, int64(reserve))
+	a.AddRegReg(x86.TapeHi, x86.RAX)
+	a.MovRegImm64(x86.CellReg, int64(reserve/2))
+	a.AddRegReg(x86.CellReg, x86.RAX)
+}
+
+// write(1, cell, 1), cells are little endian so the low byte is first
+func (rt *syscalls) Output(a *x86.Assembler, base x86.Reg, disp int32) {
+	if rt.cfg.UTF8 {
+		if !rt.utf8Used {
+			rt.utf8 = a.NewLabel()
+			rt.utf8Used = true
+		}
+		a.LoadMem(x86.Width(rt.cfg.CellSize()), x86.RAX, base, disp)
+		a.Call(rt.utf8)
+		return
+	}
+
+	a.Lea(x86.RSI, base, disp)
+	a.MovRegImm32(x86.RAX, sysWrite)
+	a.MovRegImm32(x86.RDI, 1)
+	a.MovRegImm32(x86.RDX, 1)
+	a.Syscall()
+}
+
+// read(0, rsp-8, 1) into the red zone, then widen the byte into the
+// cell. anything other than a byte arriving is the end of input. the
+// cell's address is kept in r15, which syscalls leave alone
+func (rt *syscalls) Input(a *x86.Assembler, base x86.Reg, disp int32, w x86.Width, pos lexer.Position) {
+	got, done := a.NewLabel(), a.NewLabel()
+
+	a.Lea(x86.R15, base, disp)
+	a.XorRegReg(x86.RAX, x86.RAX)
+	a.XorRegReg(x86.RDI, x86.RDI)
+	a.Lea(x86.RSI, x86.RSP, -8)
+	a.MovRegImm32(x86.RDX, 1)
+	a.Syscall()
+
+	a.CmpRegImm(x86.RAX, 1)
+	a.Jcc(x86.CondE, got)
+	switch rt.cfg.EOF {
+	case config.EOFZero:
+		a.MovMemImm(w, x86.R15, 0, 0)
+	case config.EOFMinusOne:
+		a.MovMemImm(w, x86.R15, 0, -1)
+	case config.EOFError:
+		a.Jmp(rt.eof(a, pos))
+	}
+	a.Jmp(done)
+
+	a.Bind(got)
+	a.LoadMem(x86.Byte, x86.RAX, x86.RSP, -8)
+	a.StoreMem(w, x86.R15, 0, x86.RAX)
+	a.Bind(done)
+}
+
+// the label reporting that the ',' at pos ran out of input
+func (rt *syscalls) eof(a *x86.Assembler, pos lexer.Position) x86.Label {
+	l, ok := rt.eofs[pos]
+	if !ok {
+		l = a.NewLabel()
+		rt.eofs[pos] = l
+		rt.eofOrder = append(rt.eofOrder, pos)
+	}
+	return l
+}
+
+// write(1, ...) the code point in rax as UTF-8, encoded below the stack
+// pointer. anything that isn't a code point is written as U+FFFD
+func writeUTF8(a *x86.Assembler) {
+	sizes := [5]x86.Label{}
+	for n := 1; n <= 4; n++ {
+		sizes[n] = a.NewLabel()
+	}
+	bad, write := a.NewLabel(), a.NewLabel()
+
+	a.CmpRegImm(x86.RAX, 0x80)
+	a.Jcc(x86.CondB, sizes[1])
+	a.CmpRegImm(x86.RAX, 0x800)
+	a.Jcc(x86.CondB, sizes[2])
+	// surrogates are between 0xd800 and 0xdfff
+	a.MovRegReg(x86.RCX, x86.RAX)
+	a.SubRegImm(x86.RCX, 0xd800)
+	a.CmpRegImm(x86.RCX, 0x800)
+	a.Jcc(x86.CondB, bad)
+	a.CmpRegImm(x86.RAX, 0x10000)
+	a.Jcc(x86.CondB, sizes[3])
+	a.CmpRegImm(x86.RAX, 0x110000)
+	a.Jcc(x86.CondB, sizes[4])
+	a.Bind(bad)
+	a.MovRegImm32(x86.RAX, 0xfffd)
+	a.Jmp(sizes[3])
+
+	// a lead byte marking the length then six bits at a time
+	lead := [5]int32{0, 0x00, 0xc0, 0xe0, 0xf0}
+	for n := 1; n <= 4; n++ {
+		a.Bind(sizes[n])
+		for i := 0; i < n; i++ {
+			a.MovRegReg(x86.RCX, x86.RAX)
+			if shift := 6 * (n - 1 - i); shift > 0 {
+				a.ShrRegImm(x86.RCX, byte(shift))
+			}
+			switch {
+			case i > 0:
+				a.AndRegImm(x86.RCX, 0x3f)
+				a.OrRegImm(x86.RCX, 0x80)
+			case n > 1:
+				a.OrRegImm(x86.RCX, lead[n])
+			}
+			a.StoreMem(x86.Byte, x86.RSP, int32(i-8), x86.RCX)
+		}
+		a.MovRegImm32(x86.RDX, int32(n))
+		a.Jmp(write)
+	}
+
+	a.Bind(write)
+	a.Lea(x86.RSI, x86.RSP, -8)
+	a.MovRegImm32(x86.RAX, sysWrite)
+	a.MovRegImm32(x86.RDI, 1)
+	a.Syscall()
+	a.Ret()
+}
+
+// exit(0)
+func (rt *syscalls) Exit(a *x86.Assembler) {
+	a.MovRegImm32(x86.RAX, sysExit)
+	a.XorRegReg(x86.RDI, x86.RDI)
+	a.Syscall()
+
+	if rt.utf8Used {
+		a.Bind(rt.utf8)
+		writeUTF8(a)
+	}
+
+	for _, pos := range rt.eofOrder {
+		a.Bind(rt.eofs[pos])
+		rt.fail(a, fmt.Sprintf("%s: %s", pos, config.ErrEOF))
+	}
+
+	if rt.tapeUsed {
+		a.Bind(rt.noTape)
+		rt.fail(a, "could not map the tape")
+	}
+}
+
+func (rt *syscalls) Fault(a *x86.Assembler, pos lexer.Position) {
+	rt.fail(a, fmt.Sprintf("%s: %s", pos, config.OutOfRange))
+}
+
+// print msg to stderr and exit(1). the message is kept right after the
+// code that uses it
+func (rt *syscalls) fail(a *x86.Assembler, msg string) {
+	data := a.NewLabel()
+	a.LeaLabel(x86.RSI, data)
+	a.MovRegImm32(x86.RDX, int32(len(msg)+1))
+
+	if rt.dieUsed {
+		a.Jmp(rt.die)
+	} else {
+		// write(2, rsi, rdx), exit(1)
+		rt.die = a.NewLabel()
+		rt.dieUsed = true
+		a.Bind(rt.die)
+		a.MovRegImm32(x86.RAX, sysWrite)
+		a.MovRegImm32(x86.RDI, 2)
+		a.Syscall()
+		a.MovRegImm32(x86.RAX, sysExit)
+		a.MovRegImm32(x86.RDI, 1)
+		a.Syscall()
+	}
+
+	a.Bind(data)
+	a.Data([]byte(msg + "\n"))
+}
+
+func (n *GenNative) generateBin() ([]byte, error) {
+	// build and optimize the program
+	program, err := ir.Compile(n.input, n.passes)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(n.memsize) * int64(n.cfg.CellSize())
+	rt := &syscalls{cfg: n.cfg, size: size, eofs: map[lexer.Position]x86.Label{}}
+	tape := x86.Tape{Width: x86.Width(n.cfg.CellSize()), Mode: n.cfg.Tape, Cells: int(n.memsize)}
+
+	code, err := x86.Compile(program, rt, tape)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(code) > maxCode {
+		return nil, fmt.Errorf("program too large: %d bytes of machine code", len(code))
+	}
+
+	return writeELF(code, uint64(size)), nil
+}
+
+func (n *GenNative) Generate(input string, output string) error {
+	n.input = input
+	n.output = output
+
+	b, err := n.generateBin()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(n.output, b, 0o755)
+}
@@ -0,0 +1,45 @@
+package native
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"bfcc/pkg/x86"
+)
+
+func TestRun(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "a.out")
+
+	// exit(42), with nothing bfcc generated in the way
+	a := x86.New()
+	a.MovRegImm32(x86.RAX, sysExit)
+	a.MovRegImm32(x86.RDI, 42)
+	a.Syscall()
+
+	code, err := a.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(exe, writeELF(code, 16), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var exit *exec.ExitError
+	if err := exec.Command(exe).Run(); !errors.As(err, &exit) || exit.ExitCode() != 42 {
+		t.Fatalf("got %v, want exit status 42", err)
+	}
+
+	// and a whole program writing to its tape
+	if err := New(8).Generate("++++++++[>++++++++<-]>+.+.", exe); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(exe).Output()
+	if err != nil || string(out) != "AB" {
+		t.Errorf("got %q, %v want %q", out, err, "AB")
+	}
+}
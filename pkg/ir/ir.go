@@ -0,0 +1,173 @@
+// an intermediate representation for brainfuck programs. the lexer's
+// tokens are built into a tree of typed instructions once, optimization
+// passes rewrite that tree, and then every backend generates code from it
+package ir
+
+import (
+	"fmt"
+	"strings"
+
+	"bfcc/pkg/lexer"
+)
+
+type Op int
+
+const (
+	// cell[p+Offset] += Arg
+	Add Op = iota
+	// p += Arg
+	Move
+	// cell[p+Offset] = Arg
+	Set
+	// while cell[p] != 0 { Body }
+	Loop
+	// write cell[p+Offset]
+	Output
+	// read into cell[p+Offset]
+	Input
+	// cell[p+Offset] += cell[p+Src] * Arg
+	MulAdd
+	// while cell[p] != 0 { p += Arg }
+	Scan
+)
+
+var opNames = [...]string{
+	Add:    "add",
+	Move:   "move",
+	Set:    "set",
+	Loop:   "loop",
+	Output: "output",
+	Input:  "input",
+	MulAdd: "muladd",
+	Scan:   "scan",
+}
+
+func (op Op) String() string {
+	if op < 0 || int(op) >= len(opNames) {
+		return fmt.Sprintf("op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+type Instr struct {
+	Op Op
+	// the amount, value, factor or stride depending on Op
+	Arg int
+	// cell the instruction works on, relative to the pointer
+	Offset int
+	// source cell of a MulAdd, relative to the pointer
+	Src int
+	// instructions inside of a Loop
+	Body []*Instr
+	// where in the source the instruction came from
+	Pos lexer.Position
+}
+
+func (i *Instr) String() string {
+	switch i.Op {
+	case Move, Scan:
+		return fmt.Sprintf("%s %d", i.Op, i.Arg)
+	case Loop:
+		return fmt.Sprintf("%s (%d)", i.Op, len(i.Body))
+	case Output, Input:
+		return fmt.Sprintf("%s [%d]", i.Op, i.Offset)
+	case MulAdd:
+		return fmt.Sprintf("%s [%d] [%d] %d", i.Op, i.Offset, i.Src, i.Arg)
+	default:
+		return fmt.Sprintf("%s [%d] %d", i.Op, i.Offset, i.Arg)
+	}
+}
+
+// pretty print a program, one instruction per line with loop bodies indented
+func Dump(prog []*Instr) string {
+	var sb strings.Builder
+	dump(&sb, prog, 0)
+	return sb.String()
+}
+
+func dump(sb *strings.Builder, prog []*Instr, depth int) {
+	for _, in := range prog {
+		sb.WriteString(strings.Repeat("  ", depth))
+		sb.WriteString(in.String())
+		sb.WriteByte('\n')
+
+		if in.Op == Loop {
+			dump(sb, in.Body, depth+1)
+		}
+	}
+}
+
+// build the instruction tree from a token stream
+func Build(tokens []*lexer.Token) ([]*Instr, error) {
+	// the innermost open loop is at the top of the stack
+	var stack []*Instr
+	var prog []*Instr
+	// the blocks that enclose each open loop
+	var outer [][]*Instr
+
+	for _, tok := range tokens {
+		var in *Instr
+
+		switch tok.Type {
+		case lexer.INC_PTR:
+			in = &Instr{Op: Move, Arg: tok.Repeat}
+		case lexer.DEC_PTR:
+			in = &Instr{Op: Move, Arg: -tok.Repeat}
+		case lexer.INC_CELL:
+			in = &Instr{Op: Add, Arg: tok.Repeat}
+		case lexer.DEC_CELL:
+			in = &Instr{Op: Add, Arg: -tok.Repeat}
+		case lexer.OUTPUT:
+			in = &Instr{Op: Output}
+		case lexer.INPUT:
+			in = &Instr{Op: Input}
+		case lexer.LOOP_OPEN:
+			stack = append(stack, &Instr{Op: Loop, Pos: tok.Pos})
+			outer = append(outer, prog)
+			prog = nil
+			continue
+		case lexer.LOOP_CLOSE:
+			if len(stack) == 0 {
+				return nil, &lexer.SyntaxError{Pos: tok.Pos, Msg: "unmatched ']'"}
+			}
+
+			loop := stack[len(stack)-1]
+			loop.Body = prog
+			prog = append(outer[len(outer)-1], loop)
+			stack = stack[:len(stack)-1]
+			outer = outer[:len(outer)-1]
+			continue
+		default:
+			return nil, &lexer.SyntaxError{Pos: tok.Pos, Msg: fmt.Sprintf("unhandled token: %s", tok.Type)}
+		}
+
+		in.Pos = tok.Pos
+		prog = append(prog, in)
+	}
+
+	if len(stack) != 0 {
+		return nil, &lexer.SyntaxError{Pos: stack[len(stack)-1].Pos, Msg: "unmatched '['"}
+	}
+
+	return prog, nil
+}
+
+// lex, build and optimize a brainfuck program in one go. repeated
+// characters are left for the RunLength pass so that -O0 really is
+// one instruction per character
+func Compile(input string, pm *PassManager) ([]*Instr, error) {
+	l := lexer.New(input)
+	l.SetRepeat(false)
+
+	tokens, err := l.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	prog, err := Build(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return pm.Run(prog), nil
+}
@@ -0,0 +1,78 @@
+package ir
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"bfcc/pkg/lexer"
+)
+
+func TestBuild(t *testing.T) {
+	// at -O0 every character is its own instruction, with loops nested
+	prog, err := Compile("+>\n[-[<.]],", NewPassManager())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `add [0] 1
+move 1
+loop (2)
+  add [0] -1
+  loop (2)
+    move -1
+    output [0]
+input [0]
+`
+	if got := Dump(prog); got != want {
+		t.Errorf("got:\n%swant:\n%s", got, want)
+	}
+
+	// and remembers where it came from
+	inner := prog[2].Body[1]
+	if want := (lexer.Position{Offset: 5, Line: 2, Column: 3}); inner.Pos != want {
+		t.Errorf("inner loop at %s, want %s", inner.Pos, want)
+	}
+
+	if want := (lexer.Position{Offset: 6, Line: 2, Column: 4}); inner.Body[0].Pos != want {
+		t.Errorf("move at %s, want %s", inner.Body[0].Pos, want)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		pos lexer.Position
+	}{
+		{"+]", lexer.Position{Offset: 1, Line: 1, Column: 2}},
+		{"[\n[]", lexer.Position{Offset: 0, Line: 1, Column: 1}},
+	} {
+		var serr *lexer.SyntaxError
+		if _, err := Compile(tc.src, NewPassManager()); !errors.As(err, &serr) || serr.Pos != tc.pos {
+			t.Errorf("%q: got error %v, want a syntax error at %s", tc.src, err, tc.pos)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	// every level runs the passes of the one before it
+	var prev []string
+	for n := 0; n <= MaxLevel; n++ {
+		pm, err := Level(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := pm.Names()
+		for _, p := range prev {
+			if !slices.Contains(names, p) {
+				t.Errorf("-O%d doesn't run %s", n, p)
+			}
+		}
+		prev = names
+	}
+
+	if _, err := Level(MaxLevel + 1); err == nil {
+		t.Errorf("-O%d was accepted", MaxLevel+1)
+	}
+}
@@ -0,0 +1,289 @@
+package ir
+
+import (
+	"fmt"
+
+	"bfcc/pkg/lexer"
+)
+
+// a Pass rewrites a block of instructions, returning the new block.
+// passes are free to reuse or modify the instructions they are given
+type Pass struct {
+	Name string
+	Run  func(prog []*Instr) []*Instr
+}
+
+// runs a list of passes over a program, in order
+type PassManager struct {
+	passes []Pass
+}
+
+func NewPassManager(passes ...Pass) *PassManager {
+	return &PassManager{passes: passes}
+}
+
+// the passes every backend gets unless told otherwise
+func Default() *PassManager {
+	pm, _ := Level(MaxLevel)
+	return pm
+}
+
+const MaxLevel = 3
+
+// the passes run at each optimization level
+//
+//	0: nothing, one instruction per character
+//	1: run-length folding of +-<>
+//	2: peephole rewrites, [-] and pointer offsets
+//	3: loop analysis, multiplication and scan loops
+func Level(n int) (*PassManager, error) {
+	switch n {
+	case 0:
+		return NewPassManager(), nil
+	case 1:
+		return NewPassManager(RunLength), nil
+	case 2:
+		return NewPassManager(RunLength, ClearLoops, Offsets), nil
+	case 3:
+		return NewPassManager(RunLength, ClearLoops, MulLoops, ScanLoops, Offsets), nil
+	}
+
+	return nil, fmt.Errorf("unknown optimization level %d, expected 0-%d", n, MaxLevel)
+}
+
+// append a pass to the end of the pipeline
+func (pm *PassManager) Add(p Pass) {
+	pm.passes = append(pm.passes, p)
+}
+
+// names of the passes in the order they run
+func (pm *PassManager) Names() []string {
+	var names []string
+	for _, p := range pm.passes {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// run every pass over the program
+func (pm *PassManager) Run(prog []*Instr) []*Instr {
+	if pm == nil {
+		return prog
+	}
+
+	for _, p := range pm.passes {
+		prog = p.Run(prog)
+	}
+
+	return prog
+}
+
+// apply fn to every block in the program, innermost loops first
+func walk(prog []*Instr, fn func([]*Instr) []*Instr) []*Instr {
+	for _, in := range prog {
+		if in.Op == Loop {
+			in.Body = walk(in.Body, fn)
+		}
+	}
+
+	return fn(prog)
+}
+
+// consecutive adds to the same cell and consecutive moves are merged,
+// dropping any that cancel out. a whole run is merged before deciding,
+// and keeps the position of its first character, so errors are reported
+// in the same place at every level
+var RunLength = Pass{
+	Name: "run-length",
+	Run: func(prog []*Instr) []*Instr {
+		return walk(prog, func(block []*Instr) []*Instr {
+			var res []*Instr
+			for _, in := range block {
+				if n := len(res); n > 0 && merges(res[n-1], in) {
+					res[n-1].Arg += in.Arg
+					continue
+				}
+
+				// the run before this one is over, and can go if it
+				// cancelled out. that can leave another run to carry on
+				if n := len(res); n > 0 && cancelled(res[n-1]) {
+					res = res[:n-1]
+					if n > 1 && merges(res[n-2], in) {
+						res[n-2].Arg += in.Arg
+						continue
+					}
+				}
+
+				res = append(res, in)
+			}
+
+			if n := len(res); n > 0 && cancelled(res[n-1]) {
+				res = res[:n-1]
+			}
+
+			return res
+		})
+	},
+}
+
+// whether in carries on the run that last is part of
+func merges(last, in *Instr) bool {
+	return in.Op == Add && last.Op == Add && in.Offset == last.Offset ||
+		in.Op == Move && last.Op == Move
+}
+
+// whether a merged run does nothing at all
+func cancelled(in *Instr) bool {
+	return (in.Op == Add || in.Op == Move) && in.Arg == 0
+}
+
+// [-] and [+] loop until the cell is zero, so they are just a Set
+var ClearLoops = Pass{
+	Name: "clear-loops",
+	Run: func(prog []*Instr) []*Instr {
+		return walk(prog, func(block []*Instr) []*Instr {
+			for i, in := range block {
+				if in.Op != Loop || len(in.Body) != 1 {
+					continue
+				}
+
+				b := in.Body[0]
+				if b.Op == Add && b.Offset == 0 && (b.Arg == 1 || b.Arg == -1) {
+					block[i] = &Instr{Op: Set, Arg: 0, Pos: in.Pos}
+				}
+			}
+
+			return block
+		})
+	},
+}
+
+// loops like [->+>++<<] only move the pointer around and add constants,
+// returning to where they started and decrementing the loop cell by one.
+// they run cell[p] times, so each add becomes cell[p+k] += cell[p]*c
+var MulLoops = Pass{
+	Name: "mul-loops",
+	Run: func(prog []*Instr) []*Instr {
+		return walk(prog, func(block []*Instr) []*Instr {
+			for _, in := range block {
+				if in.Op != Loop {
+					continue
+				}
+
+				// the new body ends by clearing the loop cell, so the loop
+				// is left after one pass and acts as an if. it still has to
+				// guard the body as the offsets may be outside the tape
+				if repl := mulLoop(in.Body, in.Pos); repl != nil {
+					in.Body = repl
+				}
+			}
+
+			return block
+		})
+	},
+}
+
+// the straight-line replacement for a multiplication loop body, or nil
+func mulLoop(body []*Instr, pos lexer.Position) []*Instr {
+	ptr := 0
+	deltas := map[int]int{}
+	// offsets in the order they are first touched, so output is stable
+	var order []int
+
+	for _, in := range body {
+		switch in.Op {
+		case Move:
+			ptr += in.Arg
+		case Add:
+			k := ptr + in.Offset
+			if _, ok := deltas[k]; !ok {
+				order = append(order, k)
+			}
+			deltas[k] += in.Arg
+		default:
+			return nil
+		}
+	}
+
+	if ptr != 0 || deltas[0] != -1 {
+		return nil
+	}
+
+	var res []*Instr
+	for _, k := range order {
+		if k == 0 || deltas[k] == 0 {
+			continue
+		}
+		res = append(res, &Instr{Op: MulAdd, Offset: k, Src: 0, Arg: deltas[k], Pos: pos})
+	}
+
+	return append(res, &Instr{Op: Set, Offset: 0, Arg: 0, Pos: pos})
+}
+
+// [>], [<] and friends only move the pointer until they land on a zero
+// cell, backends can search for that cell directly
+var ScanLoops = Pass{
+	Name: "scan-loops",
+	Run: func(prog []*Instr) []*Instr {
+		return walk(prog, func(block []*Instr) []*Instr {
+			for i, in := range block {
+				if in.Op != Loop || len(in.Body) != 1 {
+					continue
+				}
+
+				b := in.Body[0]
+				if b.Op == Move && b.Arg != 0 {
+					block[i] = &Instr{Op: Scan, Arg: b.Arg, Pos: in.Pos}
+				}
+			}
+
+			return block
+		})
+	},
+}
+
+// pointer moves are deferred until the end of a basic block, everything
+// in between works on cells relative to where the pointer would be. so
+// >+>++<<- becomes cell[p+1] += 1; cell[p+2] += 2; cell[p] -= 1
+var Offsets = Pass{
+	Name: "offsets",
+	Run: func(prog []*Instr) []*Instr {
+		return walk(prog, func(block []*Instr) []*Instr {
+			var res []*Instr
+			pos := 0
+			// the first of the moves being deferred
+			var from lexer.Position
+
+			// loops and scans test cell[p], so the pointer has to be
+			// where it belongs before them and at the end of the block
+			flush := func() {
+				if pos != 0 {
+					res = append(res, &Instr{Op: Move, Arg: pos, Pos: from})
+					pos = 0
+				}
+			}
+
+			for _, in := range block {
+				switch in.Op {
+				case Move:
+					if pos == 0 {
+						from = in.Pos
+					}
+					pos += in.Arg
+					continue
+				case Loop, Scan:
+					flush()
+				case MulAdd:
+					in.Offset += pos
+					in.Src += pos
+				default:
+					in.Offset += pos
+				}
+				res = append(res, in)
+			}
+			flush()
+
+			return res
+		})
+	},
+}
@@ -0,0 +1,151 @@
+package ir
+
+import (
+	"testing"
+)
+
+func TestMulLoops(t *testing.T) {
+	prog, err := Compile("+++[->+>++<<]", NewPassManager(RunLength, MulLoops))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prog) != 2 || prog[1].Op != Loop {
+		t.Fatalf("expected an add and a loop, got:\n%s", Dump(prog))
+	}
+
+	body := prog[1].Body
+	want := []Instr{
+		{Op: MulAdd, Offset: 1, Arg: 1},
+		{Op: MulAdd, Offset: 2, Arg: 2},
+		{Op: Set, Offset: 0, Arg: 0},
+	}
+
+	if len(body) != len(want) {
+		t.Fatalf("expected %d instructions in the loop, got:\n%s", len(want), Dump(body))
+	}
+
+	for i, w := range want {
+		in := body[i]
+		if in.Op != w.Op || in.Offset != w.Offset || in.Src != w.Src || in.Arg != w.Arg {
+			t.Errorf("instruction %d: got %s, want %s", i, in, &w)
+		}
+	}
+}
+
+func TestMulLoopsIgnored(t *testing.T) {
+	// unbalanced pointer movement, a loop cell changed by two and I/O in
+	// the body are all left alone
+	for _, src := range []string{"[->+]", "[-->+<]", "[->.<]", "[->[-]<]"} {
+		prog, err := Compile(src, NewPassManager(MulLoops))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, in := range prog[0].Body {
+			if in.Op == MulAdd {
+				t.Errorf("%s: unexpected rewrite:\n%s", src, Dump(prog))
+				break
+			}
+		}
+	}
+}
+
+func TestScanLoops(t *testing.T) {
+	prog, err := Compile("[>][<<<][>>>+]", NewPassManager(RunLength, ScanLoops))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prog) != 3 {
+		t.Fatalf("expected 3 instructions, got:\n%s", Dump(prog))
+	}
+
+	for i, arg := range []int{1, -3} {
+		if prog[i].Op != Scan || prog[i].Arg != arg {
+			t.Errorf("instruction %d: got %s, want scan %d", i, prog[i], arg)
+		}
+	}
+
+	if prog[2].Op != Loop {
+		t.Errorf("a loop that changes cells is not a scan, got %s", prog[2])
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	prog, err := Compile(">+>++<<->>>[<]", NewPassManager(RunLength, Offsets))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"add [1] 1",
+		"add [2] 2",
+		"add [0] -1",
+		"move 3",
+		"loop (1)",
+	}
+
+	if len(prog) != len(want) {
+		t.Fatalf("expected %d instructions, got:\n%s", len(want), Dump(prog))
+	}
+
+	for i, w := range want {
+		if prog[i].String() != w {
+			t.Errorf("instruction %d: got %s, want %s", i, prog[i], w)
+		}
+	}
+}
+
+func TestRunLength(t *testing.T) {
+	prog, err := Compile("+++-->><<<+-", NewPassManager(RunLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"add [0] 1",
+		"move -1",
+	}
+
+	if len(prog) != len(want) {
+		t.Fatalf("expected %d instructions, got:\n%s", len(want), Dump(prog))
+	}
+
+	for i, w := range want {
+		if prog[i].String() != w {
+			t.Errorf("instruction %d: got %s, want %s", i, prog[i], w)
+		}
+	}
+}
+
+func TestRunLengthPositions(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+		col  int
+	}{
+		// passing through zero part way doesn't start a new run
+		{"<--+++", "add [0] 1", 2},
+		// a run that cancels out lets the ones either side meet
+		{"+><+", "add [0] 2", 1},
+		{"+-", "", 0},
+	} {
+		prog, err := Compile(tc.src, NewPassManager(RunLength))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := len(prog) - 1
+		if tc.want == "" {
+			if len(prog) != 0 {
+				t.Errorf("%q: got:\n%s", tc.src, Dump(prog))
+			}
+			continue
+		}
+
+		if prog[last].String() != tc.want || prog[last].Pos.Column != tc.col {
+			t.Errorf("%q: got %s at %s, want %s at column %d", tc.src, prog[last], prog[last].Pos, tc.want, tc.col)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -34,6 +35,33 @@ type Token struct {
 	Type string
 	// number of consecutive tokens of this type
 	Repeat int
+	// where the first character of the token is
+	Pos Position
+	// just past the last character of the token
+	End Position
+}
+
+// a location in the brainfuck source, lines and columns start at 1
+type Position struct {
+	// byte offset into the source
+	Offset int
+	Line   int
+	// counted in characters, not bytes
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// a problem with the program itself, such as an unbalanced bracket
+type SyntaxError struct {
+	Pos Position
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
 }
 
 type Lexer struct {
@@ -43,6 +71,9 @@ type Lexer struct {
 	// the current position the lexer points to
 	position int
 
+	// line and column of position
+	line, column int
+
 	// map of characters to their token type
 	known map[string]string
 
@@ -51,12 +82,10 @@ type Lexer struct {
 }
 
 func New(input string) *Lexer {
+	// whitespace is kept, like any other comment, so positions line up
+	// with the source
 	l := &Lexer{input: input}
-
-	// clean up our input
-	l.input = strings.ReplaceAll(l.input, "\n", "")
-	l.input = strings.ReplaceAll(l.input, "\r", "")
-	l.input = strings.ReplaceAll(l.input, " ", "")
+	l.Zero()
 
 	l.registerKnowTokens()
 
@@ -84,8 +113,19 @@ func (l *Lexer) handleCharRepetition() {
 	}
 }
 
+// turn collapsing of repeated characters on or off. with it off
+// every character becomes its own token with a Repeat of 1
+func (l *Lexer) SetRepeat(repeat bool) {
+	if repeat {
+		l.handleCharRepetition()
+	} else {
+		l.repeat = make(map[string]bool)
+	}
+}
+
 func Repl() *Lexer {
 	l := &Lexer{}
+	l.Zero()
 
 	l.registerKnowTokens()
 
@@ -94,24 +134,20 @@ func Repl() *Lexer {
 	return l
 }
 
-// takes an input string and returns its tokens
-// overwrites lexers input, for use with the repl only.
-func (l *Lexer) Read(inst string) []*Token {
+// takes an input string and returns its tokens, checking that its
+// brackets are balanced. overwrites lexers input, for use with the repl only.
+func (l *Lexer) Read(inst string) ([]*Token, error) {
 	l.input = inst
-	var res []*Token
-	tok := l.Next()
+	l.Zero()
 
-	for tok.Type != EOF {
-		res = append(res, tok)
-		tok = l.Next()
-	}
-
-	return res
+	return l.Parse()
 }
 
 // reset the parsers position
 func (l *Lexer) Zero() {
 	l.position = 0
+	l.line = 1
+	l.column = 1
 }
 
 // returns all the tokens from the given input
@@ -127,6 +163,66 @@ func (l *Lexer) Tokens() []*Token {
 	return res
 }
 
+// returns all the tokens from the given input, or a *SyntaxError
+// pointing at the first bracket that doesn't have a partner
+func (l *Lexer) Parse() ([]*Token, error) {
+	var res []*Token
+	// where each currently open '[' is
+	var open []Position
+
+	tok := l.Next()
+	for tok.Type != EOF {
+		switch tok.Type {
+		case LOOP_OPEN:
+			open = append(open, tok.Pos)
+		case LOOP_CLOSE:
+			if len(open) == 0 {
+				return nil, &SyntaxError{Pos: tok.Pos, Msg: "unmatched ']'"}
+			}
+			open = open[:len(open)-1]
+		}
+
+		res = append(res, tok)
+		tok = l.Next()
+	}
+
+	if len(open) != 0 {
+		return nil, &SyntaxError{Pos: open[len(open)-1], Msg: "unmatched '['"}
+	}
+
+	return res, nil
+}
+
+// pretty print tokens, one per line with where it starts and how many
+// times it repeats
+func Dump(tokens []*Token) string {
+	var sb strings.Builder
+	for _, tok := range tokens {
+		fmt.Fprintf(&sb, "%s\t%s %d\n", tok.Pos, tok.Type, tok.Repeat)
+	}
+	return sb.String()
+}
+
+// the current position of the lexer
+func (l *Lexer) pos() Position {
+	return Position{Offset: l.position, Line: l.line, Column: l.column}
+}
+
+// move past one byte of input, keeping track of lines and columns
+func (l *Lexer) advance() {
+	c := l.input[l.position]
+	l.position++
+
+	switch {
+	case c == '\n':
+		l.line++
+		l.column = 1
+	case c&0xc0 != 0x80:
+		// continuation bytes of a utf-8 character don't start a new column
+		l.column++
+	}
+}
+
 // advance the parser and get the next token in the input
 // while counting repeated characters
 func (l *Lexer) Next() *Token {
@@ -137,12 +233,13 @@ func (l *Lexer) Next() *Token {
 		// is this a valid token?
 		_, ok := l.known[char]
 		if ok {
+			start := l.pos()
 
 			// can we repeat token
 			repeatable := l.repeat[char]
 			if !repeatable {
-				l.position++
-				return &Token{Type: char, Repeat: 1}
+				l.advance()
+				return &Token{Type: char, Repeat: 1, Pos: start, End: l.pos()}
 			}
 
 			begin := l.position
@@ -155,17 +252,48 @@ func (l *Lexer) Next() *Token {
 					break
 				}
 
-				l.position++
+				l.advance()
 			}
 
 			// this gives us how many times this character was repeated
 			count := l.position - begin
-			return &Token{Type: char, Repeat: count}
+			return &Token{Type: char, Repeat: count, Pos: start, End: l.pos()}
 		}
 		// ignore unknown characters
-		l.position++
+		l.advance()
 	}
 
 	// if we've made it here, we are done, send EOF
-	return &Token{Type: EOF, Repeat: 1}
+	return &Token{Type: EOF, Repeat: 1, Pos: l.pos(), End: l.pos()}
+}
+
+// match every '[' with its ']' ahead of time. the result holds the index
+// of the matching bracket for bracket tokens and -1 for everything else
+func Jumps(tokens []*Token) ([]int, error) {
+	jumps := make([]int, len(tokens))
+	var open []int
+
+	for i, tok := range tokens {
+		jumps[i] = -1
+
+		switch tok.Type {
+		case LOOP_OPEN:
+			open = append(open, i)
+		case LOOP_CLOSE:
+			if len(open) == 0 {
+				return nil, &SyntaxError{Pos: tok.Pos, Msg: "unmatched ']'"}
+			}
+
+			j := open[len(open)-1]
+			open = open[:len(open)-1]
+			jumps[i] = j
+			jumps[j] = i
+		}
+	}
+
+	if len(open) != 0 {
+		return nil, &SyntaxError{Pos: tokens[open[len(open)-1]].Pos, Msg: "unmatched '['"}
+	}
+
+	return jumps, nil
 }
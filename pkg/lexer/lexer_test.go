@@ -15,3 +15,71 @@ func TestParse(t *testing.T) {
 		fmt.Printf("%s [%d]\n", t.Type, t.Repeat)
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		line  int
+		col   int
+		msg   string
+	}{
+		{"+++\n[->+<\n]]\n", 3, 2, "unmatched ']'"},
+		{"+\n  [[-]\n", 2, 3, "unmatched '['"},
+		{"é ]", 1, 3, "unmatched ']'"},
+	}
+
+	for _, tt := range tests {
+		_, err := New(tt.input).Parse()
+
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q: expected a *SyntaxError, got %v", tt.input, err)
+			continue
+		}
+
+		if serr.Pos.Line != tt.line || serr.Pos.Column != tt.col || serr.Msg != tt.msg {
+			t.Errorf("%q: got %s, want %d:%d: %s", tt.input, serr, tt.line, tt.col, tt.msg)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	tokens, err := New("++ a\n>>>[-]").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ      string
+		pos, end Position
+	}{
+		{INC_CELL, Position{0, 1, 1}, Position{2, 1, 3}},
+		{INC_PTR, Position{5, 2, 1}, Position{8, 2, 4}},
+		{LOOP_OPEN, Position{8, 2, 4}, Position{9, 2, 5}},
+		{DEC_CELL, Position{9, 2, 5}, Position{10, 2, 6}},
+		{LOOP_CLOSE, Position{10, 2, 6}, Position{11, 2, 7}},
+	}
+
+	if len(tokens) != len(want) {
+		t.Fatalf("expected %d tokens, got %d", len(want), len(tokens))
+	}
+
+	for i, w := range want {
+		tok := tokens[i]
+		if tok.Type != w.typ || tok.Pos != w.pos || tok.End != w.end {
+			t.Errorf("token %d: got %s %+v-%+v, want %s %+v-%+v", i, tok.Type, tok.Pos, tok.End, w.typ, w.pos, w.end)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	tokens, err := New("++ a\n>>>[-]").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "1:1\t+ 2\n2:1\t> 3\n2:4\t[ 1\n2:5\t- 1\n2:6\t] 1\n"
+	if got := Dump(tokens); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"bfcc/pkg/config"
 	"bfcc/pkg/gen/interp"
 	repl "github.com/openengineer/go-repl"
 )
@@ -66,9 +67,13 @@ func (h *Bhandler) Eval(buffer string) string {
 				log.Print(err)
 			}
 
-			h.rpl.Eval(string(b))
+			if err := h.rpl.Eval(string(b)); err != nil {
+				return fmt.Sprintf("%s: %s", args[0], err)
+			}
 		default:
-			h.rpl.Eval(buffer)
+			if err := h.rpl.Eval(buffer); err != nil {
+				return err.Error()
+			}
 		}
 
 	} else {
@@ -78,14 +83,17 @@ func (h *Bhandler) Eval(buffer string) string {
 	return ""
 }
 
-func Readline() error {
+// run the interactive interpreter with a tape of cells that behave as
+// cfg says
+func Readline(cells int, cfg config.Config) error {
 	h := &Bhandler{}
 	h.r = repl.NewRepl(h)
 	const prompt = "\x1b[32m[bf]\x1b[0m \x1b[34m~ $\x1b[0m "
 	h.prompt = prompt
 	h.prompt = "~$ "
 
-	rpl := interp.NewRepl(100)
+	rpl := interp.NewRepl(cells)
+	rpl.SetConfig(cfg)
 	rpl.Output = os.Stdout
 	rpl.Input = os.Stdin
 
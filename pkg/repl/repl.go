@@ -8,11 +8,13 @@ import (
 	"os"
 	"strings"
 
+	"bfcc/pkg/config"
 	"bfcc/pkg/gen/interp"
 )
 
-func Start() error {
-	repl := interp.NewRepl(100)
+func Start(cells int, cfg config.Config) error {
+	repl := interp.NewRepl(cells)
+	repl.SetConfig(cfg)
 	const prompt = "\x1b[32m[bf]\x1b[0m \x1b[34m~ $\x1b[0m "
 
 	var outbuf bytes.Buffer
@@ -58,11 +60,15 @@ func Start() error {
 				log.Println(err)
 			}
 
-			repl.Eval(string(b))
+			if err := repl.Eval(string(b)); err != nil {
+				fmt.Printf("%s: %s\n", cmd[1], err)
+			}
 			continue
 
 		default:
-			repl.Eval(line)
+			if err := repl.Eval(line); err != nil {
+				fmt.Println(err)
+			}
 		}
 	}
 }
@@ -0,0 +1,209 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+)
+
+type Op uint8
+
+const (
+	// cell[p+Off] += Arg
+	OpAdd Op = iota
+	// cell[p+Off] = Arg
+	OpSet
+	// p += Arg
+	OpMove
+	// cell[p+Off] += cell[p+Src] * Arg
+	OpMulAdd
+	// write cell[p+Off]
+	OpOutput
+	// read into cell[p+Off]
+	OpInput
+	// while cell[p] != 0 { p += Arg }
+	OpScan
+	// if cell[p] == 0, carry on after instruction Src
+	OpJz
+	// if cell[p] != 0, carry on after instruction Src
+	OpJnz
+	// p += Arg, then OpJnz. the end of most loops once offsets are folded
+	OpMoveJnz
+	// p += Arg, then OpJz. the start of most loops
+	OpMoveJz
+)
+
+var opNames = [...]string{
+	OpAdd:     "add",
+	OpSet:     "set",
+	OpMove:    "move",
+	OpMulAdd:  "muladd",
+	OpOutput:  "output",
+	OpInput:   "input",
+	OpScan:    "scan",
+	OpJz:      "jz",
+	OpJnz:     "jnz",
+	OpMoveJnz: "movejnz",
+	OpMoveJz:  "movejz",
+}
+
+func (op Op) String() string {
+	if int(op) >= len(opNames) {
+		return fmt.Sprintf("op(%d)", int(op))
+	}
+	return opNames[op]
+}
+
+// one fixed size bytecode instruction. jumps are resolved to the index of
+// the instruction to carry on after, so the loop running the code can
+// always step to the next one
+type Instr struct {
+	Op  Op
+	Off int32
+	// the source cell of OpMulAdd, or where a jump goes
+	Src int32
+	Arg int32
+}
+
+func (in Instr) String() string {
+	switch in.Op {
+	case OpMove, OpScan:
+		return fmt.Sprintf("%s %d", in.Op, in.Arg)
+	case OpJz, OpJnz:
+		return fmt.Sprintf("%s %d", in.Op, in.Src)
+	case OpMoveJz, OpMoveJnz:
+		return fmt.Sprintf("%s %d %d", in.Op, in.Arg, in.Src)
+	case OpOutput, OpInput:
+		return fmt.Sprintf("%s [%d]", in.Op, in.Off)
+	case OpMulAdd:
+		return fmt.Sprintf("%s [%d] [%d] %d", in.Op, in.Off, in.Src, in.Arg)
+	default:
+		return fmt.Sprintf("%s [%d] %d", in.Op, in.Off, in.Arg)
+	}
+}
+
+// a compiled program
+type Program struct {
+	Code []Instr
+	// where in the source every instruction came from, for errors
+	Pos []lexer.Position
+}
+
+// pretty print the bytecode, one numbered instruction per line
+func (p *Program) String() string {
+	var sb strings.Builder
+	for i, in := range p.Code {
+		fmt.Fprintf(&sb, "%4d  %s\n", i, in)
+	}
+	return sb.String()
+}
+
+// turn an optimized ir program into bytecode
+func Compile(prog []*ir.Instr) (*Program, error) {
+	p := &Program{}
+	if err := p.block(prog); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Program) emit(in Instr, pos lexer.Position) int {
+	p.Code = append(p.Code, in)
+	p.Pos = append(p.Pos, pos)
+	return len(p.Code) - 1
+}
+
+// operands have to fit in 32 bits to keep instructions small, which is
+// far more than any real program needs
+func operand(in *ir.Instr, n int) (int32, error) {
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%s: %d is too large for the vm", in.Pos, n)
+	}
+	return int32(n), nil
+}
+
+func (p *Program) block(block []*ir.Instr) error {
+	for _, in := range block {
+		off, err := operand(in, in.Offset)
+		if err != nil {
+			return err
+		}
+
+		src, err := operand(in, in.Src)
+		if err != nil {
+			return err
+		}
+
+		arg, err := operand(in, in.Arg)
+		if err != nil {
+			return err
+		}
+
+		switch in.Op {
+		case ir.Add:
+			p.emit(Instr{Op: OpAdd, Off: off, Arg: arg}, in.Pos)
+		case ir.Set:
+			p.emit(Instr{Op: OpSet, Off: off, Arg: arg}, in.Pos)
+		case ir.Move:
+			p.emit(Instr{Op: OpMove, Arg: arg}, in.Pos)
+		case ir.MulAdd:
+			p.emit(Instr{Op: OpMulAdd, Off: off, Src: src, Arg: arg}, in.Pos)
+		case ir.Output:
+			p.emit(Instr{Op: OpOutput, Off: off}, in.Pos)
+		case ir.Input:
+			p.emit(Instr{Op: OpInput, Off: off}, in.Pos)
+		case ir.Scan:
+			p.emit(Instr{Op: OpScan, Arg: arg}, in.Pos)
+		case ir.Loop:
+			if err := p.loop(in); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unhandled instruction: %s", in)
+		}
+	}
+
+	return nil
+}
+
+func (p *Program) loop(in *ir.Instr) error {
+	// moves are only left before loops and at the end of their bodies,
+	// both get fused into the jump. nothing jumps to just after a plain
+	// move, so it can take the jump's place
+	open := len(p.Code) - 1
+	if open >= 0 && p.Code[open].Op == OpMove {
+		p.Code[open].Op = OpMoveJz
+		p.Pos[open] = in.Pos
+	} else {
+		open = p.emit(Instr{Op: OpJz}, in.Pos)
+	}
+
+	if err := p.block(in.Body); err != nil {
+		return err
+	}
+
+	// a body ending by clearing the loop cell only ever runs once, as
+	// multiplication loops do, so there's nothing to jump back for
+	if n := len(in.Body); n > 0 {
+		last := in.Body[n-1]
+		if last.Op == ir.Set && last.Offset == 0 && last.Arg == 0 {
+			p.Code[open].Src = int32(len(p.Code) - 1)
+			return nil
+		}
+	}
+
+	end := len(p.Code) - 1
+	if end > open && p.Code[end].Op == OpMove {
+		p.Code[end].Op = OpMoveJnz
+		p.Code[end].Src = int32(open)
+		p.Pos[end] = in.Pos
+	} else {
+		end = p.emit(Instr{Op: OpJnz, Src: int32(open)}, in.Pos)
+	}
+
+	p.Code[open].Src = int32(end)
+	return nil
+}
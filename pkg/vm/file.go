@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/lexer"
+)
+
+// a compiled program saved to disk, usually as a .bfc file, along with
+// everything needed to run it the way it was compiled. all numbers are
+// little endian:
+//
+//	magic    "\x7fBFC"
+//	version  uint16
+//	cell     uint8 bits, uint8 eof, uint8 tape, uint8 flags (1 is utf8)
+//	cells    uint64
+//	source   [32]byte sha256 of the brainfuck source
+//	count    uint32 instructions, each one
+//	         uint8 op, int32 off, int32 src, int32 arg,
+//	         uint32 offset, uint32 line, uint32 column
+//	checksum uint32 crc32 (IEEE) of everything before it
+type File struct {
+	Config config.Config
+	// number of cells on the tape
+	Cells int
+	// sha256 of the source the program was compiled from
+	Source  [32]byte
+	Program *Program
+}
+
+const (
+	magic = "\x7fBFC"
+	// bumped whenever the layout or the meaning of an op changes, older
+	// files are refused rather than run differently
+	Version = 1
+
+	flagUTF8 = 1 << 0
+
+	headerSize = len(magic) + 2 + 4 + 8 + 32 + 4
+	instrSize  = 1 + 3*4 + 3*4
+)
+
+// the file isn't bytecode, or is damaged
+var ErrBadFile = errors.New("not a bfcc bytecode file")
+
+// whether b starts like a bytecode file, it may still be damaged
+func IsFile(b []byte) bool {
+	return len(b) >= len(magic) && string(b[:len(magic)]) == magic
+}
+
+func (f *File) MarshalBinary() ([]byte, error) {
+	if err := f.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if f.Cells <= 0 || f.Cells > config.MaxCells {
+		return nil, fmt.Errorf("a tape of %d cells can't be written", f.Cells)
+	}
+
+	if f.Program == nil || len(f.Program.Code) != len(f.Program.Pos) {
+		return nil, fmt.Errorf("no program to write")
+	}
+
+	if len(f.Program.Code) > math.MaxUint32 {
+		return nil, fmt.Errorf("%d instructions is too many for a bytecode file", len(f.Program.Code))
+	}
+
+	var flags byte
+	if f.Config.UTF8 {
+		flags |= flagUTF8
+	}
+
+	b := make([]byte, 0, headerSize+len(f.Program.Code)*instrSize+4)
+	b = append(b, magic...)
+	b = binary.LittleEndian.AppendUint16(b, Version)
+	b = append(b, byte(f.Config.CellBits), byte(f.Config.EOF), byte(f.Config.Tape), flags)
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.Cells))
+	b = append(b, f.Source[:]...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(f.Program.Code)))
+
+	for i, in := range f.Program.Code {
+		pos := f.Program.Pos[i]
+
+		b = append(b, byte(in.Op))
+		b = binary.LittleEndian.AppendUint32(b, uint32(in.Off))
+		b = binary.LittleEndian.AppendUint32(b, uint32(in.Src))
+		b = binary.LittleEndian.AppendUint32(b, uint32(in.Arg))
+		b = binary.LittleEndian.AppendUint32(b, uint32(pos.Offset))
+		b = binary.LittleEndian.AppendUint32(b, uint32(pos.Line))
+		b = binary.LittleEndian.AppendUint32(b, uint32(pos.Column))
+	}
+
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// read a file written by MarshalBinary, checking it over well enough that
+// running it can't go wrong in ways the source couldn't
+func (f *File) UnmarshalBinary(b []byte) error {
+	if !IsFile(b) || len(b) < headerSize+4 {
+		return ErrBadFile
+	}
+
+	body, sum := b[:len(b)-4], binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadFile)
+	}
+
+	if v := binary.LittleEndian.Uint16(b[4:]); v != Version {
+		return fmt.Errorf("bytecode version %d, this bfcc only runs version %d", v, Version)
+	}
+
+	cfg := config.Config{
+		CellBits: int(b[6]),
+		EOF:      config.EOF(b[7]),
+		Tape:     config.Tape(b[8]),
+		UTF8:     b[9]&flagUTF8 != 0,
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrBadFile, err)
+	}
+
+	// the tape is allocated before the program runs, so a damaged or
+	// hostile file mustn't be able to ask for more than bfcc itself would
+	cells := binary.LittleEndian.Uint64(b[10:])
+	if cells == 0 || cells > config.MaxCells {
+		return fmt.Errorf("%w: %d cells", ErrBadFile, cells)
+	}
+
+	var source [32]byte
+	copy(source[:], b[18:50])
+
+	n := int(binary.LittleEndian.Uint32(b[50:]))
+	code := body[headerSize:]
+	if len(code) != n*instrSize {
+		return fmt.Errorf("%w: expected %d instructions", ErrBadFile, n)
+	}
+
+	p := &Program{Code: make([]Instr, n), Pos: make([]lexer.Position, n)}
+	for i := range n {
+		c := code[i*instrSize:]
+
+		in := Instr{
+			Op:  Op(c[0]),
+			Off: int32(binary.LittleEndian.Uint32(c[1:])),
+			Src: int32(binary.LittleEndian.Uint32(c[5:])),
+			Arg: int32(binary.LittleEndian.Uint32(c[9:])),
+		}
+
+		if int(in.Op) >= len(opNames) {
+			return fmt.Errorf("%w: unknown op %d", ErrBadFile, in.Op)
+		}
+
+		// jumps have to land on the program, everything else can only
+		// move the pointer, which the vm already checks
+		switch in.Op {
+		case OpJz, OpJnz, OpMoveJz, OpMoveJnz:
+			if in.Src < 0 || int(in.Src) >= n {
+				return fmt.Errorf("%w: instruction %d jumps to %d", ErrBadFile, i, in.Src)
+			}
+		}
+
+		p.Code[i] = in
+		p.Pos[i] = lexer.Position{
+			Offset: int(binary.LittleEndian.Uint32(c[13:])),
+			Line:   int(binary.LittleEndian.Uint32(c[17:])),
+			Column: int(binary.LittleEndian.Uint32(c[21:])),
+		}
+	}
+
+	*f = File{Config: cfg, Cells: int(cells), Source: source, Program: p}
+	return nil
+}
@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+
+	"bfcc/pkg/config"
+)
+
+func TestFile(t *testing.T) {
+	v := New(64)
+	v.SetConfig(config.Config{CellBits: 16, EOF: config.EOFMinusOne, Tape: config.TapeWrap, UTF8: true})
+
+	src := "++[>+++<-]>[.<]\n,"
+	b, err := v.Source(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f File
+	if err := f.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Config != v.cfg || f.Cells != 64 {
+		t.Errorf("got %+v with %d cells", f.Config, f.Cells)
+	}
+
+	want, err := v.compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f.Program, want) {
+		t.Errorf("got:\n%swant:\n%s", f.Program, want)
+	}
+
+	// and the same file comes back out
+	again, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(again, b) {
+		t.Error("file changed after reading it back")
+	}
+}
+
+func TestBadFile(t *testing.T) {
+	v := New(8)
+	good, err := v.Source("+[>+<-]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change a byte of the file, fixing the checksum up after unless the
+	// checksum is what's being tested
+	broken := func(i int, c byte, sum bool) []byte {
+		b := bytes.Clone(good)
+		b[i] = c
+		if sum {
+			resum(b)
+		}
+		return b
+	}
+
+	// the same file asking for another number of cells
+	cells := func(n uint64) []byte {
+		b := bytes.Clone(good)
+		binary.LittleEndian.PutUint64(b[10:], n)
+		return resum(b)
+	}
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		bad  bool
+	}{
+		{"empty", nil, true},
+		{"source", []byte("+[>+<-]"), true},
+		{"truncated", good[:len(good)-5], true},
+		{"header only", resum(bytes.Clone(good[:headerSize+4])), true},
+		{"short header", good[:headerSize-1], true},
+		{"checksum", broken(headerSize, byte(OpSet), false), true},
+		{"version", broken(4, Version+1, true), false},
+		{"cell bits", broken(6, 12, true), true},
+		{"eof", broken(7, 9, true), true},
+		{"tape", broken(8, 9, true), true},
+		{"no cells", cells(0), true},
+		{"too many cells", cells(config.MaxCells + 1), true},
+		{"16 GiB of cells", cells(1 << 31), true},
+		{"count", broken(50, 9, true), true},
+		{"op", broken(headerSize, 200, true), true},
+		{"jump", broken(headerSize+instrSize+5, 100, true), true},
+	} {
+		var f File
+		err := f.UnmarshalBinary(tc.b)
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+			continue
+		}
+
+		if errors.Is(err, ErrBadFile) != tc.bad {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+// fix up the checksum at the end of b after changing it
+func resum(b []byte) []byte {
+	binary.LittleEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+	return b
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	good, err := New(8).Source("+[>,.<-]")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(good)
+	f.Add(good[:headerSize])
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// most changes are caught by the checksum, so the fuzzer gets to
+		// see past it too
+		if len(b) < 4 {
+			return
+		}
+
+		for _, b := range [][]byte{b, resum(bytes.Clone(b))} {
+			var file File
+			if file.UnmarshalBinary(b) != nil {
+				continue
+			}
+
+			if file.Cells <= 0 || file.Cells > config.MaxCells {
+				t.Errorf("read a file with %d cells", file.Cells)
+			}
+
+			// whatever was read can be written again
+			if _, err := file.MarshalBinary(); err != nil {
+				t.Errorf("can't write a file that was read: %s", err)
+			}
+		}
+	})
+}
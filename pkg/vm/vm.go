@@ -0,0 +1,306 @@
+// this package compiles a brainfuck program to compact bytecode and runs
+// it in a tight loop. it is much faster than the interp backend, which
+// keeps more state around so it can stop programs part way through
+package vm
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/gen"
+	"bfcc/pkg/ir"
+)
+
+func init() {
+	gen.Register(gen.Backend{
+		Name:        "vm",
+		Aliases:     []string{"bytecode"},
+		Description: "compiled to bytecode and run straight away, works on any platform",
+		Caps:        gen.InProcess | gen.Source,
+		New: func(o gen.Options) gen.Generator {
+			v := New(int(o.Cells))
+			v.SetPasses(o.Passes)
+			v.SetConfig(o.Config)
+			v.Input = o.Input
+			v.Output = o.Output
+			return v
+		},
+	})
+}
+
+type VM struct {
+	// usually stdin, for ',' read instruction
+	Input io.Reader
+	// usually stdout, for writing to
+	Output io.Writer
+	// the tape after a program has run
+	Memory []uint64
+	// size of the tape
+	memsize int
+	// optimizations to run before compiling
+	passes *ir.PassManager
+	// how cells behave
+	cfg config.Config
+	// cells are kept to these bits after every change
+	mask uint64
+	// index into Memory of cell 0, growing tapes can have cells left of it
+	origin int
+}
+
+func New(stacksize int) *VM {
+	v := &VM{
+		memsize: stacksize,
+		passes:  ir.Default(),
+	}
+	v.SetConfig(config.Default())
+
+	return v
+}
+
+// choose which optimization passes run before compiling
+func (v *VM) SetPasses(pm *ir.PassManager) {
+	v.passes = pm
+}
+
+// choose how cells behave
+func (v *VM) SetConfig(cfg config.Config) {
+	v.cfg = cfg
+	v.mask = cfg.Mask()
+}
+
+func (v *VM) compile(input string) (*Program, error) {
+	prog, err := ir.Compile(input, v.passes)
+	if err != nil {
+		return nil, err
+	}
+
+	return Compile(prog)
+}
+
+// compile and run an entire brainfuck program, there is no output file
+func (v *VM) Generate(input string, output string) error {
+	p, err := v.compile(input)
+	if err != nil {
+		return err
+	}
+
+	return v.Run(p)
+}
+
+// the compiled program as a bytecode file, which can be run later without
+// compiling it again
+func (v *VM) Source(input string) ([]byte, error) {
+	p, err := v.compile(input)
+	if err != nil {
+		return nil, err
+	}
+
+	f := File{Config: v.cfg, Cells: v.memsize, Source: sha256.Sum256([]byte(input)), Program: p}
+	return f.MarshalBinary()
+}
+
+// run a compiled program on a fresh tape. output is buffered, and flushed
+// before reading input and when the program stops
+func (v *VM) Run(p *Program) (err error) {
+	v.Memory = make([]uint64, v.memsize)
+	v.origin = 0
+
+	if v.Output == nil {
+		v.Output = io.Discard
+	}
+	out := bufio.NewWriter(v.Output)
+
+	defer func() {
+		if ferr := out.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+
+	// everything the loop touches is kept in locals, reach is only called
+	// when a cell isn't on the tape yet
+	code := p.Code
+	mem := v.Memory
+	mask := v.mask
+	ptr := 0
+
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+
+		switch in.Op {
+		case OpAdd:
+			i := ptr + int(in.Off)
+			if uint(i) >= uint(len(mem)) {
+				if i, ptr, err = v.reach(p, pc, i, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+			mem[i] = (mem[i] + uint64(in.Arg)) & mask
+
+		case OpSet:
+			i := ptr + int(in.Off)
+			if uint(i) >= uint(len(mem)) {
+				if i, ptr, err = v.reach(p, pc, i, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+			mem[i] = uint64(in.Arg) & mask
+
+		case OpMove:
+			ptr += int(in.Arg)
+
+		case OpMulAdd:
+			s, d := ptr+int(in.Src), ptr+int(in.Off)
+			if uint(s) >= uint(len(mem)) || uint(d) >= uint(len(mem)) {
+				if s, d, ptr, err = v.pair(p, pc, ptr, in); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+			mem[d] = (mem[d] + mem[s]*uint64(in.Arg)) & mask
+
+		case OpOutput:
+			i := ptr + int(in.Off)
+			if uint(i) >= uint(len(mem)) {
+				if i, ptr, err = v.reach(p, pc, i, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+
+			if v.cfg.UTF8 {
+				_, err = out.WriteRune(config.Rune(mem[i]))
+			} else {
+				err = out.WriteByte(byte(mem[i]))
+			}
+
+			if err != nil {
+				return err
+			}
+
+		case OpInput:
+			i := ptr + int(in.Off)
+			if uint(i) >= uint(len(mem)) {
+				if i, ptr, err = v.reach(p, pc, i, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+
+			if err := out.Flush(); err != nil {
+				return err
+			}
+
+			if err := v.read(i); err != nil {
+				return fmt.Errorf("%s: %w", p.Pos[pc], err)
+			}
+
+		case OpScan:
+			for {
+				if uint(ptr) >= uint(len(mem)) {
+					if _, ptr, err = v.reach(p, pc, ptr, ptr); err != nil {
+						return err
+					}
+					mem = v.Memory
+				}
+
+				if mem[ptr] == 0 {
+					break
+				}
+				ptr += int(in.Arg)
+			}
+
+		case OpMoveJnz:
+			ptr += int(in.Arg)
+			fallthrough
+
+		case OpJnz:
+			if uint(ptr) >= uint(len(mem)) {
+				if _, ptr, err = v.reach(p, pc, ptr, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+
+			if mem[ptr] != 0 {
+				pc = int(in.Src)
+			}
+
+		case OpMoveJz:
+			ptr += int(in.Arg)
+			fallthrough
+
+		case OpJz:
+			if uint(ptr) >= uint(len(mem)) {
+				if _, ptr, err = v.reach(p, pc, ptr, ptr); err != nil {
+					return err
+				}
+				mem = v.Memory
+			}
+
+			if mem[ptr] == 0 {
+				pc = int(in.Src)
+			}
+		}
+	}
+
+	return nil
+}
+
+// the cell at index i isn't on the tape. fixed tapes fail, wrapping tapes
+// bring i and the pointer back around, and growing tapes make room for i
+// unless it is past config.MaxGrow. growing to the left moves every cell along, so the pointer is returned
+// too
+func (v *VM) reach(p *Program, pc, i, ptr int) (int, int, error) {
+	switch v.cfg.Tape {
+	case config.TapeWrap:
+		n := len(v.Memory)
+		return (i%n + n) % n, (ptr%n + n) % n, nil
+
+	case config.TapeGrow:
+		// i is an index rather than a cell, and growing to the left
+		// moves cell 0 along by as much as every other cell
+		old := v.origin
+		var ok bool
+		if v.Memory, v.origin, ok = config.Grow(v.Memory, v.origin, i-v.origin); !ok {
+			return 0, 0, fmt.Errorf("%s: %s", p.Pos[pc], config.OutOfRange)
+		}
+		shift := v.origin - old
+		return i + shift, ptr + shift, nil
+
+	default:
+		return 0, 0, fmt.Errorf("%s: %s", p.Pos[pc], config.OutOfRange)
+	}
+}
+
+// the source and destination of a multiplication when either isn't on the
+// tape. the source is reached again in case reaching the destination grew
+// the tape
+func (v *VM) pair(p *Program, pc, ptr int, in *Instr) (int, int, int, error) {
+	var idx [3]int
+	var err error
+
+	for k, off := range [...]int32{in.Src, in.Off, in.Src} {
+		i := ptr + int(off)
+		if uint(i) >= uint(len(v.Memory)) {
+			if i, ptr, err = v.reach(p, pc, i, ptr); err != nil {
+				return 0, 0, 0, err
+			}
+		}
+		idx[k] = i
+	}
+
+	return idx[2], idx[1], ptr, nil
+}
+
+// read a byte of input into cell i, following the configured eof
+// behaviour when there is none left
+func (v *VM) read(i int) error {
+	var err error
+	v.Memory[i], err = v.cfg.ReadCell(v.Input, v.Memory[i])
+	return err
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bfcc/pkg/ir"
+)
+
+func TestCompile(t *testing.T) {
+	prog, err := ir.Compile(">[-]+[>[->++<]>]<.", ir.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Compile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the moves are fused into the loop jumps, and the multiplication loop
+	// doesn't jump back at all
+	want := `   0  set [1] 0
+   1  add [1] 1
+   2  movejz 1 6
+   3  movejz 1 5
+   4  muladd [1] [0] 2
+   5  set [0] 0
+   6  movejnz 1 2
+   7  output [-1]
+   8  move -1
+`
+	if got := p.String(); got != want {
+		t.Errorf("got:\n%swant:\n%s", got, want)
+	}
+}
+
+func BenchmarkMandelbrot(b *testing.B) {
+	src, err := os.ReadFile(filepath.Join("..", "..", "examples", "mandelbrot.bf"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		v := New(30_000)
+		v.Input = strings.NewReader("")
+		v.Output = io.Discard
+
+		if err := v.Generate(string(src), ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
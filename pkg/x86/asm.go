@@ -0,0 +1,450 @@
+// a tiny x86-64 machine code assembler. it only knows the handful of
+// instructions that brainfuck programs need, but it knows them well enough
+// that the native and jit backends don't need an external toolchain
+package x86
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type Reg byte
+
+// general purpose registers, in encoding order
+const (
+	RAX Reg = iota
+	RCX
+	RDX
+	RBX
+	RSP
+	RBP
+	RSI
+	RDI
+	R8
+	R9
+	R10
+	R11
+	R12
+	R13
+	R14
+	R15
+)
+
+// operand size of a memory access
+type Width int
+
+const (
+	Byte  Width = 1
+	Word  Width = 2
+	Dword Width = 4
+	Qword Width = 8
+)
+
+// condition codes for Jcc
+type Cond byte
+
+const (
+	CondB  Cond = 0x2
+	CondAE Cond = 0x3
+	CondE  Cond = 0x4
+	CondNE Cond = 0x5
+	CondL  Cond = 0xc
+	CondGE Cond = 0xd
+)
+
+type Label int
+
+type fixup struct {
+	// where the rel32 lives in the buffer
+	at    int
+	label Label
+}
+
+type Assembler struct {
+	buf []byte
+	// bound offset of every label, -1 until Bind is called
+	labels []int
+	fixups []fixup
+}
+
+func New() *Assembler {
+	return &Assembler{}
+}
+
+// the current length of the emitted code
+func (a *Assembler) Len() int {
+	return len(a.buf)
+}
+
+// create a label that can be jumped to before or after it is bound
+func (a *Assembler) NewLabel() Label {
+	a.labels = append(a.labels, -1)
+	return Label(len(a.labels) - 1)
+}
+
+// bind the label to the current position
+func (a *Assembler) Bind(l Label) {
+	a.labels[l] = len(a.buf)
+}
+
+// the offset of a bound label from the start of the code
+func (a *Assembler) Offset(l Label) int {
+	return a.labels[l]
+}
+
+// resolve all jumps and return the finished machine code
+func (a *Assembler) Bytes() ([]byte, error) {
+	for _, f := range a.fixups {
+		target := a.labels[f.label]
+		if target < 0 {
+			return nil, fmt.Errorf("jump to unbound label %d", f.label)
+		}
+
+		rel := int32(target - (f.at + 4))
+		binary.LittleEndian.PutUint32(a.buf[f.at:], uint32(rel))
+	}
+
+	return a.buf, nil
+}
+
+func (a *Assembler) emit(b ...byte) {
+	a.buf = append(a.buf, b...)
+}
+
+func (a *Assembler) imm16(v int32) {
+	a.buf = binary.LittleEndian.AppendUint16(a.buf, uint16(v))
+}
+
+func (a *Assembler) imm32(v int32) {
+	a.buf = binary.LittleEndian.AppendUint32(a.buf, uint32(v))
+}
+
+func (a *Assembler) imm64(v int64) {
+	a.buf = binary.LittleEndian.AppendUint64(a.buf, uint64(v))
+}
+
+// emit a REX prefix when one is needed. byteReg forces an empty REX so
+// that registers 4-7 mean spl/bpl/sil/dil rather than ah/ch/dh/bh
+func (a *Assembler) rex(w bool, reg, rm Reg, byteReg bool) {
+	var r byte = 0x40
+	if w {
+		r |= 0x08
+	}
+	if reg >= R8 {
+		r |= 0x04
+	}
+	if rm >= R8 {
+		r |= 0x01
+	}
+
+	if r != 0x40 || (byteReg && reg >= RSP && reg <= RDI) {
+		a.emit(r)
+	}
+}
+
+// the operand size prefix, plus REX.W for qwords
+func (a *Assembler) prefix(w Width, reg, base Reg) {
+	if w == Word {
+		a.emit(0x66)
+	}
+	a.rex(w == Qword, reg, base, w == Byte)
+}
+
+// encode a [base + disp] memory operand with the given reg/opcode field
+func (a *Assembler) mem(reg byte, base Reg, disp int32) {
+	b := byte(base) & 7
+
+	switch {
+	case disp == 0 && b != 5:
+		a.emit(reg<<3 | b)
+	case disp >= -128 && disp <= 127:
+		a.emit(0x40 | reg<<3 | b)
+	default:
+		a.emit(0x80 | reg<<3 | b)
+	}
+
+	// rsp and r12 can only be addressed through a SIB byte
+	if b == 4 {
+		a.emit(0x24)
+	}
+
+	switch {
+	case disp == 0 && b != 5:
+	case disp >= -128 && disp <= 127:
+		a.emit(byte(int8(disp)))
+	default:
+		a.imm32(disp)
+	}
+}
+
+// register to register modrm byte
+func (a *Assembler) direct(reg byte, rm Reg) {
+	a.emit(0xc0 | reg<<3 | byte(rm)&7)
+}
+
+// immediate sized to the operand, 8 bit forms are picked when possible
+func (a *Assembler) aluImm(w Width, imm int32, rm func()) {
+	switch {
+	case w == Byte:
+		a.emit(0x80)
+		rm()
+		a.emit(byte(imm))
+	case imm >= -128 && imm <= 127:
+		a.emit(0x83)
+		rm()
+		a.emit(byte(int8(imm)))
+	case w == Word:
+		a.emit(0x81)
+		rm()
+		a.imm16(imm)
+	default:
+		a.emit(0x81)
+		rm()
+		a.imm32(imm)
+	}
+}
+
+// add r64, imm32
+func (a *Assembler) AddRegImm(r Reg, imm int32) {
+	a.rex(true, 0, r, false)
+	a.aluImm(Qword, imm, func() { a.direct(0, r) })
+}
+
+// sub r64, imm32
+func (a *Assembler) SubRegImm(r Reg, imm int32) {
+	a.rex(true, 0, r, false)
+	a.aluImm(Qword, imm, func() { a.direct(5, r) })
+}
+
+// cmp r64, imm32
+func (a *Assembler) CmpRegImm(r Reg, imm int32) {
+	a.rex(true, 0, r, false)
+	a.aluImm(Qword, imm, func() { a.direct(7, r) })
+}
+
+// and r64, imm32
+func (a *Assembler) AndRegImm(r Reg, imm int32) {
+	a.rex(true, 0, r, false)
+	a.aluImm(Qword, imm, func() { a.direct(4, r) })
+}
+
+// or r64, imm32
+func (a *Assembler) OrRegImm(r Reg, imm int32) {
+	a.rex(true, 0, r, false)
+	a.aluImm(Qword, imm, func() { a.direct(1, r) })
+}
+
+// shr r64, imm8
+func (a *Assembler) ShrRegImm(r Reg, imm byte) {
+	a.rex(true, 0, r, false)
+	a.emit(0xc1)
+	a.direct(5, r)
+	a.emit(imm)
+}
+
+// mov r32, imm32 which zero extends into the full register
+func (a *Assembler) MovRegImm32(r Reg, imm int32) {
+	a.rex(false, 0, r, false)
+	a.emit(0xb8 + byte(r)&7)
+	a.imm32(imm)
+}
+
+// mov r64, imm64
+func (a *Assembler) MovRegImm64(r Reg, imm int64) {
+	a.rex(true, 0, r, false)
+	a.emit(0xb8 + byte(r)&7)
+	a.imm64(imm)
+}
+
+// mov r64, r64
+func (a *Assembler) MovRegReg(dst, src Reg) {
+	a.rex(true, src, dst, false)
+	a.emit(0x89)
+	a.direct(byte(src)&7, dst)
+}
+
+// add r64, r64
+func (a *Assembler) AddRegReg(dst, src Reg) {
+	a.rex(true, src, dst, false)
+	a.emit(0x01)
+	a.direct(byte(src)&7, dst)
+}
+
+// sub r64, r64
+func (a *Assembler) SubRegReg(dst, src Reg) {
+	a.rex(true, src, dst, false)
+	a.emit(0x29)
+	a.direct(byte(src)&7, dst)
+}
+
+// cmp r64, r64
+func (a *Assembler) CmpRegReg(x, y Reg) {
+	a.rex(true, y, x, false)
+	a.emit(0x39)
+	a.direct(byte(y)&7, x)
+}
+
+// xor r32, r32, the usual way of zeroing a register
+func (a *Assembler) XorRegReg(dst, src Reg) {
+	a.rex(false, src, dst, false)
+	a.emit(0x31)
+	a.direct(byte(src)&7, dst)
+}
+
+// test r64, r64
+func (a *Assembler) TestRegReg(x, y Reg) {
+	a.rex(true, y, x, false)
+	a.emit(0x85)
+	a.direct(byte(y)&7, x)
+}
+
+// lea r64, [base + disp]
+func (a *Assembler) Lea(dst, base Reg, disp int32) {
+	a.rex(true, dst, base, false)
+	a.emit(0x8d)
+	a.mem(byte(dst)&7, base, disp)
+}
+
+// mov r64, [base + disp]
+func (a *Assembler) LoadReg(dst, base Reg, disp int32) {
+	a.rex(true, dst, base, false)
+	a.emit(0x8b)
+	a.mem(byte(dst)&7, base, disp)
+}
+
+// mov [base + disp], r64
+func (a *Assembler) StoreReg(base Reg, disp int32, src Reg) {
+	a.rex(true, src, base, false)
+	a.emit(0x89)
+	a.mem(byte(src)&7, base, disp)
+}
+
+// add w [base + disp], imm
+func (a *Assembler) AddMemImm(w Width, base Reg, disp int32, imm int32) {
+	a.prefix(w, 0, base)
+	a.aluImm(w, imm, func() { a.mem(0, base, disp) })
+}
+
+// cmp w [base + disp], imm
+func (a *Assembler) CmpMemImm(w Width, base Reg, disp int32, imm int32) {
+	a.prefix(w, 0, base)
+	a.aluImm(w, imm, func() { a.mem(7, base, disp) })
+}
+
+// mov w [base + disp], imm
+func (a *Assembler) MovMemImm(w Width, base Reg, disp int32, imm int32) {
+	a.prefix(w, 0, base)
+	if w == Byte {
+		a.emit(0xc6)
+	} else {
+		a.emit(0xc7)
+	}
+	a.mem(0, base, disp)
+
+	switch w {
+	case Byte:
+		a.emit(byte(imm))
+	case Word:
+		a.imm16(imm)
+	default:
+		a.imm32(imm)
+	}
+}
+
+// load a w sized cell into dst, zero extending it
+func (a *Assembler) LoadMem(w Width, dst, base Reg, disp int32) {
+	switch w {
+	case Byte:
+		a.rex(false, dst, base, false)
+		a.emit(0x0f, 0xb6)
+	case Word:
+		a.rex(false, dst, base, false)
+		a.emit(0x0f, 0xb7)
+	case Dword:
+		a.rex(false, dst, base, false)
+		a.emit(0x8b)
+	case Qword:
+		a.rex(true, dst, base, false)
+		a.emit(0x8b)
+	}
+	a.mem(byte(dst)&7, base, disp)
+}
+
+// store the low w bytes of src into [base + disp]
+func (a *Assembler) StoreMem(w Width, base Reg, disp int32, src Reg) {
+	a.prefix(w, src, base)
+	if w == Byte {
+		a.emit(0x88)
+	} else {
+		a.emit(0x89)
+	}
+	a.mem(byte(src)&7, base, disp)
+}
+
+// add w [base + disp], src
+func (a *Assembler) AddMemReg(w Width, base Reg, disp int32, src Reg) {
+	a.prefix(w, src, base)
+	if w == Byte {
+		a.emit(0x00)
+	} else {
+		a.emit(0x01)
+	}
+	a.mem(byte(src)&7, base, disp)
+}
+
+// imul dst, src, imm32. only the low 32 bits are kept unless w is a qword
+func (a *Assembler) ImulRegImm(w Width, dst, src Reg, imm int32) {
+	a.rex(w == Qword, dst, src, false)
+	a.emit(0x69)
+	a.direct(byte(dst)&7, src)
+	a.imm32(imm)
+}
+
+// imul dst, src on 64 bit registers
+func (a *Assembler) ImulRegReg(dst, src Reg) {
+	a.rex(true, dst, src, false)
+	a.emit(0x0f, 0xaf)
+	a.direct(byte(dst)&7, src)
+}
+
+// lea r64, [rip + label], the address of a label in the code
+func (a *Assembler) LeaLabel(dst Reg, l Label) {
+	a.rex(true, dst, 0, false)
+	a.emit(0x8d, 0x05|(byte(dst)&7)<<3)
+	a.fixups = append(a.fixups, fixup{at: len(a.buf), label: l})
+	a.imm32(0)
+}
+
+// raw bytes, for data kept alongside the code
+func (a *Assembler) Data(b []byte) {
+	a.emit(b...)
+}
+
+// jmp rel32
+func (a *Assembler) Jmp(l Label) {
+	a.emit(0xe9)
+	a.fixups = append(a.fixups, fixup{at: len(a.buf), label: l})
+	a.imm32(0)
+}
+
+// call rel32
+func (a *Assembler) Call(l Label) {
+	a.emit(0xe8)
+	a.fixups = append(a.fixups, fixup{at: len(a.buf), label: l})
+	a.imm32(0)
+}
+
+// jcc rel32
+func (a *Assembler) Jcc(c Cond, l Label) {
+	a.emit(0x0f, 0x80|byte(c))
+	a.fixups = append(a.fixups, fixup{at: len(a.buf), label: l})
+	a.imm32(0)
+}
+
+func (a *Assembler) Syscall() {
+	a.emit(0x0f, 0x05)
+}
+
+func (a *Assembler) Ret() {
+	a.emit(0xc3)
+}
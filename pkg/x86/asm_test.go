@@ -0,0 +1,100 @@
+package x86
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestEncoding(t *testing.T) {
+	// the bytes are what GNU as assembles the same instruction to
+	for _, tc := range []struct {
+		asm  string
+		emit func(a *Assembler)
+		want string
+	}{
+		// rbp and r13 can't be a base without a displacement, so a zero
+		// disp8 is added
+		{"mov rax, [rbp]", func(a *Assembler) { a.LoadReg(RAX, RBP, 0) }, "48 8b 45 00"},
+		{"mov rax, [r13]", func(a *Assembler) { a.LoadReg(RAX, R13, 0) }, "49 8b 45 00"},
+		{"mov rax, [rbp+8]", func(a *Assembler) { a.LoadReg(RAX, RBP, 8) }, "48 8b 45 08"},
+		{"mov eax, [r13]", func(a *Assembler) { a.LoadMem(Dword, RAX, R13, 0) }, "41 8b 45 00"},
+
+		// rsp and r12 need a SIB byte
+		{"mov rax, [rsp]", func(a *Assembler) { a.LoadReg(RAX, RSP, 0) }, "48 8b 04 24"},
+		{"mov rax, [r12]", func(a *Assembler) { a.LoadReg(RAX, R12, 0) }, "49 8b 04 24"},
+		{"mov rax, [r12+8]", func(a *Assembler) { a.LoadReg(RAX, R12, 8) }, "49 8b 44 24 08"},
+		{"mov rax, [rsp+0x200]", func(a *Assembler) { a.LoadReg(RAX, RSP, 0x200) }, "48 8b 84 24 00 02 00 00"},
+		{"add [r12], rax", func(a *Assembler) { a.AddMemReg(Qword, R12, 0, RAX) }, "49 01 04 24"},
+		{"movzx eax, word [r12+4]", func(a *Assembler) { a.LoadMem(Word, RAX, R12, 4) }, "41 0f b7 44 24 04"},
+
+		// displacements switch to 32 bits outside of -128 to 127
+		{"mov r9, [rdi+127]", func(a *Assembler) { a.LoadReg(R9, RDI, 127) }, "4c 8b 4f 7f"},
+		{"mov r9, [rdi+128]", func(a *Assembler) { a.LoadReg(R9, RDI, 128) }, "4c 8b 8f 80 00 00 00"},
+		{"mov r9, [rdi-128]", func(a *Assembler) { a.LoadReg(R9, RDI, -128) }, "4c 8b 4f 80"},
+		{"mov r9, [rdi-129]", func(a *Assembler) { a.LoadReg(R9, RDI, -129) }, "4c 8b 8f 7f ff ff ff"},
+
+		// 16 bit cells have the operand size prefix before any REX
+		{"add word [rbx+2], 1000", func(a *Assembler) { a.AddMemImm(Word, RBX, 2, 1000) }, "66 81 43 02 e8 03"},
+		{"add word [r13], 1", func(a *Assembler) { a.AddMemImm(Word, R13, 0, 1) }, "66 41 83 45 00 01"},
+		{"mov word [rbx], 0x1234", func(a *Assembler) { a.MovMemImm(Word, RBX, 0, 0x1234) }, "66 c7 03 34 12"},
+
+		// and 64 bit cells have REX.W, other sizes don't
+		{"add dword [rbx], 1000", func(a *Assembler) { a.AddMemImm(Dword, RBX, 0, 1000) }, "81 03 e8 03 00 00"},
+		{"add qword [rbx+8], -1", func(a *Assembler) { a.AddMemImm(Qword, RBX, 8, -1) }, "48 83 43 08 ff"},
+		{"mov rax, qword [rbx-8]", func(a *Assembler) { a.LoadMem(Qword, RAX, RBX, -8) }, "48 8b 43 f8"},
+		{"mov [rbx+2], r10", func(a *Assembler) { a.StoreReg(RBX, 2, R10) }, "4c 89 53 02"},
+
+		// byte registers 4 to 7 need an empty REX to not mean ah to bh
+		{"mov byte [rbx], sil", func(a *Assembler) { a.StoreMem(Byte, RBX, 0, RSI) }, "40 88 33"},
+		{"add byte [r13+1], 0xff", func(a *Assembler) { a.AddMemImm(Byte, R13, 1, -1) }, "41 80 45 01 ff"},
+
+		{"lea rax, [rdi+24]", func(a *Assembler) { a.Lea(RAX, RDI, 24) }, "48 8d 47 18"},
+		{"mov r12, 0x123456789", func(a *Assembler) { a.MovRegImm64(R12, 0x123456789) }, "49 bc 89 67 45 23 01 00 00 00"},
+		{"imul r8, rcx, 3", func(a *Assembler) { a.ImulRegImm(Qword, R8, RCX, 3) }, "4c 69 c1 03 00 00 00"},
+		{"cmp r13, rbx", func(a *Assembler) { a.CmpRegReg(R13, RBX) }, "49 39 dd"},
+		{"xor eax, eax", func(a *Assembler) { a.XorRegReg(RAX, RAX) }, "31 c0"},
+		{"add r12, 1000", func(a *Assembler) { a.AddRegImm(R12, 1000) }, "49 81 c4 e8 03 00 00"},
+	} {
+		a := New()
+		tc.emit(a)
+
+		got, err := a.Bytes()
+		if err != nil {
+			t.Fatalf("%s: %s", tc.asm, err)
+		}
+
+		want, _ := hex.DecodeString(strings.ReplaceAll(tc.want, " ", ""))
+		if string(got) != string(want) {
+			t.Errorf("%s: got % x, want % x", tc.asm, got, want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	a := New()
+	top := a.NewLabel()
+	end := a.NewLabel()
+
+	a.Bind(top)
+	a.Jcc(CondE, end)
+	a.Jmp(top)
+	a.Bind(end)
+	a.Ret()
+
+	got, err := a.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// je +5 over the jmp, and jmp -11 back to the start
+	want := []byte{0x0f, 0x84, 5, 0, 0, 0, 0xe9, 0xf5, 0xff, 0xff, 0xff, 0xc3}
+	if string(got) != string(want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+
+	a.Jmp(a.NewLabel())
+	if _, err := a.Bytes(); err == nil {
+		t.Error("jumping to an unbound label didn't fail")
+	}
+}
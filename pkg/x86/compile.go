@@ -0,0 +1,256 @@
+package x86
+
+import (
+	"fmt"
+	"math"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+)
+
+// CellReg holds the address of the current cell for the whole program.
+// it is callee saved in both the syscall and the go assembly conventions
+const CellReg = RBX
+
+// the ends of the tape, set up by Runtime.Enter. a cell is on the tape
+// when TapeLo <= its address < TapeHi
+const (
+	TapeLo = R12
+	TapeHi = R13
+)
+
+// bytes of address space a growing tape of w byte cells reserves, with
+// room for config.MaxGrow cells either side of the middle. the kernel only
+// hands out pages as they are touched, so the tape grows as it is used
+func GrowReserve(w Width) int {
+	return 2 * config.MaxGrow * int(w)
+}
+
+// a Runtime decides how compiled code starts, talks to the outside world
+// and stops. executables use raw syscalls, the jit hands control back to go
+type Runtime interface {
+	// set up CellReg to point at the first cell, and TapeLo and TapeHi
+	Enter(a *Assembler)
+	// write the low byte of the cell at [base + disp]
+	Output(a *Assembler, base Reg, disp int32)
+	// read a byte into the w sized cell at [base + disp], pos is where the
+	// ',' is in case there is no input left
+	Input(a *Assembler, base Reg, disp int32, w Width, pos lexer.Position)
+	// finish the program
+	Exit(a *Assembler)
+	// stop the program, the instruction at pos used a cell off the tape
+	Fault(a *Assembler, pos lexer.Position)
+}
+
+// how the compiled code uses the tape
+type Tape struct {
+	// size of a cell
+	Width Width
+	// fixed and growing tapes check every cell against TapeLo and TapeHi,
+	// wrapping ones bring the pointer back around
+	Mode config.Tape
+	// number of cells, only needed to wrap around
+	Cells int
+}
+
+type compiler struct {
+	a    *Assembler
+	rt   Runtime
+	tape Tape
+	// out of line calls to Runtime.Fault, one per source position
+	faults map[lexer.Position]Label
+	order  []lexer.Position
+}
+
+// compile a program to x86-64 machine code
+func Compile(prog []*ir.Instr, rt Runtime, tape Tape) ([]byte, error) {
+	if tape.Mode == config.TapeWrap && int64(tape.Cells)*int64(tape.Width) > math.MaxInt32 {
+		return nil, fmt.Errorf("tape of %d cells is too big to wrap around", tape.Cells)
+	}
+
+	c := &compiler{
+		a:      New(),
+		rt:     rt,
+		tape:   tape,
+		faults: map[lexer.Position]Label{},
+	}
+
+	rt.Enter(c.a)
+
+	if err := c.block(prog); err != nil {
+		return nil, err
+	}
+
+	rt.Exit(c.a)
+
+	for _, pos := range c.order {
+		c.a.Bind(c.faults[pos])
+		rt.Fault(c.a, pos)
+	}
+
+	return c.a.Bytes()
+}
+
+// the label reporting that the instruction at pos left the tape
+func (c *compiler) fault(pos lexer.Position) Label {
+	l, ok := c.faults[pos]
+	if !ok {
+		l = c.a.NewLabel()
+		c.faults[pos] = l
+		c.order = append(c.order, pos)
+	}
+	return l
+}
+
+// size of a wrapping tape in bytes
+func (c *compiler) span() int64 {
+	return int64(c.tape.Cells) * int64(c.tape.Width)
+}
+
+// n bytes brought into [0, span)
+func (c *compiler) wrap(n int64) int32 {
+	n %= c.span()
+	if n < 0 {
+		n += c.span()
+	}
+	return int32(n)
+}
+
+// the memory operand for the cell at offset from the pointer. fixed and
+// growing tapes check it is on the tape, wrapping tapes work its address
+// out in scratch
+func (c *compiler) cell(offset int, scratch Reg, pos lexer.Position) (Reg, int32) {
+	a := c.a
+	disp := int32(offset) * int32(c.tape.Width)
+
+	if c.tape.Mode == config.TapeWrap {
+		// CellReg is always on the tape, so the cell is at most one
+		// span past the end of it
+		d := c.wrap(int64(disp))
+		if d == 0 {
+			return CellReg, 0
+		}
+
+		on := a.NewLabel()
+		a.Lea(scratch, CellReg, d)
+		a.CmpRegReg(scratch, TapeHi)
+		a.Jcc(CondB, on)
+		a.SubRegImm(scratch, int32(c.span()))
+		a.Bind(on)
+		return scratch, 0
+	}
+
+	addr := CellReg
+	if disp != 0 {
+		a.Lea(scratch, CellReg, disp)
+		addr = scratch
+	}
+
+	fault := c.fault(pos)
+	a.CmpRegReg(addr, TapeLo)
+	a.Jcc(CondB, fault)
+	a.CmpRegReg(addr, TapeHi)
+	a.Jcc(CondAE, fault)
+
+	return CellReg, disp
+}
+
+// move the pointer by n cells
+func (c *compiler) move(n int) {
+	a := c.a
+
+	if c.tape.Mode != config.TapeWrap {
+		a.AddRegImm(CellReg, int32(n)*int32(c.tape.Width))
+		return
+	}
+
+	d := c.wrap(int64(n) * int64(c.tape.Width))
+	if d == 0 {
+		return
+	}
+
+	on := a.NewLabel()
+	a.AddRegImm(CellReg, d)
+	a.CmpRegReg(CellReg, TapeHi)
+	a.Jcc(CondB, on)
+	a.SubRegImm(CellReg, int32(c.span()))
+	a.Bind(on)
+}
+
+// immediates are at most 32 bits. they are truncated to the cell size,
+// which wraps them, but a qword cell needs the whole constant
+func fits(w Width, n int) bool {
+	return w != Qword || int(int32(n)) == n
+}
+
+func (c *compiler) block(block []*ir.Instr) error {
+	a := c.a
+	w := c.tape.Width
+
+	for _, in := range block {
+		switch in.Op {
+		case ir.Move:
+			c.move(in.Arg)
+		case ir.Add:
+			base, disp := c.cell(in.Offset, RSI, in.Pos)
+			if fits(w, in.Arg) {
+				a.AddMemImm(w, base, disp, int32(in.Arg))
+			} else {
+				a.MovRegImm64(RAX, int64(in.Arg))
+				a.AddMemReg(w, base, disp, RAX)
+			}
+		case ir.Set:
+			base, disp := c.cell(in.Offset, RSI, in.Pos)
+			if fits(w, in.Arg) {
+				a.MovMemImm(w, base, disp, int32(in.Arg))
+			} else {
+				a.MovRegImm64(RAX, int64(in.Arg))
+				a.StoreMem(w, base, disp, RAX)
+			}
+		case ir.MulAdd:
+			src, sdisp := c.cell(in.Src, RSI, in.Pos)
+			dst, ddisp := c.cell(in.Offset, RDX, in.Pos)
+			a.LoadMem(w, RAX, src, sdisp)
+			if fits(w, in.Arg) {
+				a.ImulRegImm(w, RAX, RAX, int32(in.Arg))
+			} else {
+				a.MovRegImm64(RCX, int64(in.Arg))
+				a.ImulRegReg(RAX, RCX)
+			}
+			a.AddMemReg(w, dst, ddisp, RAX)
+		case ir.Output:
+			base, disp := c.cell(in.Offset, RSI, in.Pos)
+			c.rt.Output(a, base, disp)
+		case ir.Input:
+			base, disp := c.cell(in.Offset, RSI, in.Pos)
+			c.rt.Input(a, base, disp, w, in.Pos)
+		case ir.Scan:
+			loop, done := a.NewLabel(), a.NewLabel()
+			a.Bind(loop)
+			base, disp := c.cell(0, RSI, in.Pos)
+			a.CmpMemImm(w, base, disp, 0)
+			a.Jcc(CondE, done)
+			c.move(in.Arg)
+			a.Jmp(loop)
+			a.Bind(done)
+		case ir.Loop:
+			start, end := a.NewLabel(), a.NewLabel()
+			base, disp := c.cell(0, RSI, in.Pos)
+			a.CmpMemImm(w, base, disp, 0)
+			a.Jcc(CondE, end)
+			a.Bind(start)
+			if err := c.block(in.Body); err != nil {
+				return err
+			}
+			base, disp = c.cell(0, RSI, in.Pos)
+			a.CmpMemImm(w, base, disp, 0)
+			a.Jcc(CondNE, start)
+			a.Bind(end)
+		default:
+			return fmt.Errorf("unhandled instruction: %s", in)
+		}
+	}
+
+	return nil
+}
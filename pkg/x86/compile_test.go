@@ -0,0 +1,90 @@
+package x86
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"bfcc/pkg/config"
+	"bfcc/pkg/ir"
+	"bfcc/pkg/lexer"
+)
+
+// a Runtime that only records what it was asked for
+type recorder struct {
+	inputs []lexer.Position
+	faults []lexer.Position
+}
+
+func (r *recorder) Enter(a *Assembler)                        {}
+func (r *recorder) Output(a *Assembler, base Reg, disp int32) {}
+func (r *recorder) Exit(a *Assembler)                         { a.Ret() }
+
+func (r *recorder) Input(a *Assembler, base Reg, disp int32, w Width, pos lexer.Position) {
+	r.inputs = append(r.inputs, pos)
+}
+
+func (r *recorder) Fault(a *Assembler, pos lexer.Position) {
+	r.faults = append(r.faults, pos)
+}
+
+func TestCompile(t *testing.T) {
+	prog, err := ir.Compile(",\n [,]", ir.NewPassManager())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := &recorder{}
+	if _, err := Compile(prog, rt, Tape{Width: Byte}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first line is two bytes long with its newline
+	at := func(line, col int) lexer.Position {
+		return lexer.Position{Offset: col - 1 + 2*(line-1), Line: line, Column: col}
+	}
+
+	// both ends of the loop check the same cell, which is reported once
+	if want := []lexer.Position{at(1, 1), at(2, 2), at(2, 3)}; !slices.Equal(rt.faults, want) {
+		t.Errorf("got faults at %v, want %v", rt.faults, want)
+	}
+
+	if want := []lexer.Position{at(1, 1), at(2, 3)}; !slices.Equal(rt.inputs, want) {
+		t.Errorf("got inputs at %v, want %v", rt.inputs, want)
+	}
+
+	// wrapping tapes don't check cells at all
+	rt = &recorder{}
+	if _, err := Compile(prog, rt, Tape{Width: Byte, Mode: config.TapeWrap, Cells: 4}); err != nil || len(rt.faults) != 0 {
+		t.Errorf("wrap: got faults at %v, %v", rt.faults, err)
+	}
+
+	// but only up to what a 32 bit displacement reaches
+	if _, err := Compile(prog, rt, Tape{Width: Qword, Mode: config.TapeWrap, Cells: 1 << 28}); err == nil {
+		t.Error("wrapping a 2 GiB tape compiled")
+	}
+}
+
+func TestQwordConstants(t *testing.T) {
+	prog := []*ir.Instr{{Op: ir.Add, Arg: 1 << 40}}
+
+	// a 64 bit cell needs the whole constant, loaded with mov rax, imm64
+	code, err := Compile(prog, &recorder{}, Tape{Width: Qword, Mode: config.TapeWrap, Cells: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{0x48, 0xb8, 0, 0, 0, 0, 0, 1, 0, 0}; !bytes.Contains(code, want) {
+		t.Errorf("no mov rax, 1<<40 in % x", code)
+	}
+
+	// narrower cells wrap it anyway, so it is truncated into an immediate
+	code, err = Compile(prog, &recorder{}, Tape{Width: Dword, Mode: config.TapeWrap, Cells: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(code, []byte{0x48, 0xb8}) {
+		t.Errorf("mov rax, imm64 for a dword cell in % x", code)
+	}
+}